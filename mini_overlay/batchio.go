@@ -0,0 +1,371 @@
+// cmd/mini-overlay/batchio.go
+//
+// 把 TUN<->UDP 两个转发方向的逐包收发换成批量路径：UDP 一侧借
+// golang.org/x/net/ipv4 的 ReadBatch/WriteBatch 一次系统调用收发最多
+// -batch-size 个包（内核层面就是 recvmmsg/sendmmsg）；如果内核支持
+// UDP_SEGMENT/UDP_GRO（5.0+），发往同一个对端、大小相同的若干帧还会被拼成
+// 一个 GSO/GRO 大包，连 IP/UDP 头的开销都摊薄了——这是 wireguard-go 的 conn
+// 包在 Linux 上用的同一套思路，启动时探测一次，探测失败就退化成不带 GSO 的
+// 普通批量收发，不影响功能。
+//
+// TUN 这一侧没法用同样的手段：songgao/water 的 Interface 不对外暴露底层 fd，
+// 拿不到 readv(2)/writev(2) 能用的句柄，每次还是只能 Read/Write 一个包；这里
+// 用几圈复用的缓冲区（tunRing）把单包路径上的堆分配去掉——省下来的是内存分配
+// 开销而不是系统调用次数，真正的"一次系统调用发多个包"只发生在 UDP 一侧。
+package main
+
+import (
+	"encoding/binary"
+	"log"
+	"net"
+	"unsafe"
+
+	"github.com/songgao/water"
+	"golang.org/x/net/ipv4"
+	"golang.org/x/sys/unix"
+	"k8s.io/klog/v2"
+)
+
+const (
+	defaultBatchSize = 64
+
+	// gsoMaxSegments/gsoMaxBytes 是单条 UDP_SEGMENT 消息的硬上限：一个 UDP
+	// 数据报的长度字段只有 16 位，超过 65535 字节内核会直接拒绝
+	// （EMSGSIZE/EINVAL），整条合并消息都发不出去；这跟 -batch-size 是否配得
+	// 更大无关，和 wireguard-go 的 conn 包一样，在合并时单独兜底这个上限。
+	gsoMaxSegments = 64
+	gsoMaxBytes    = 65535
+
+	// UDP_SEGMENT/UDP_GRO 是 5.0 内核才加的 socket option/cmsg type，有些
+	// 发行版打包的 golang.org/x/sys/unix 版本还没收录这两个常量，这里按内核
+	// 头文件（linux/udp.h）里的数值直接写死，避免因为依赖版本不同编译不过。
+	// 发送侧用 UDP_SEGMENT(103) 的 cmsg 告诉内核怎么切分 GSO 大包；内核在接收
+	// 侧上报 GRO 合并前的分段大小时，复用的是 UDP_GRO 的值（104）而不是
+	// UDP_SEGMENT，两个 cmsg type 不能混用，否则 parseGROSegmentSize 永远匹配
+	// 不上，粘在一起的包会被当成一个完整帧传给上层，AEAD 认证必然失败。
+	udpSegmentCmsgType = 103 // UDP_SEGMENT：发送侧 GSO cmsg type
+	udpGROCmsgType     = 104 // UDP_GRO：接收侧内核上报 GRO 分段大小用的 cmsg type，和下面的 setsockopt 同值
+	udpGROSockopt      = 104 // UDP_GRO：setsockopt(SOL_UDP)，打开后内核会把能合并的包粘着一起收上来
+
+	// maxFrameSize 是一帧（1 字节 type + 加密开销 + innerMTU）的容量上限，
+	// 发送侧、以及不开 GRO 时接收侧的缓冲区都按这个尺寸分配，足够装下最大的
+	// 一个内层包。
+	maxFrameSize = 1 + 24 + innerMTU + 64
+)
+
+// batchIO 是 UDP 侧批量收发的共享状态：启动时探测一次 GSO/GRO 能力，之后
+// 两个转发方向都复用同一个 PacketConn。
+type batchIO struct {
+	pc        *ipv4.PacketConn
+	batchSize int
+	gso       bool
+}
+
+// newBatchIO 探测一次本机内核是否支持 UDP_GRO/UDP_SEGMENT，探测失败就只用不
+// 带 GSO 的批量收发（仍然比逐包 WriteToUDP/ReadFromUDP 省系统调用），不影响
+// 功能。
+func newBatchIO(conn *net.UDPConn, batchSize int, wantGSO bool) *batchIO {
+	if batchSize < 1 {
+		batchSize = defaultBatchSize
+	}
+	b := &batchIO{pc: ipv4.NewPacketConn(conn), batchSize: batchSize}
+	if wantGSO {
+		b.gso = probeGSO(conn)
+	}
+	klog.Infof("batch I/O: batch-size=%d gso=%v", b.batchSize, b.gso)
+	return b
+}
+
+// probeGSO 尝试在真实 socket 上打开 UDP_GRO；UDP_GRO 和 UDP_SEGMENT 是同一批
+// 内核改动加入的，打开 UDP_GRO 成功基本就意味着 UDP_SEGMENT 也能用。
+func probeGSO(conn *net.UDPConn) bool {
+	sc, err := conn.SyscallConn()
+	if err != nil {
+		return false
+	}
+	var setErr error
+	if ctrlErr := sc.Control(func(fd uintptr) {
+		setErr = unix.SetsockoptInt(int(fd), unix.IPPROTO_UDP, udpGROSockopt, 1)
+	}); ctrlErr != nil {
+		return false
+	}
+	if setErr != nil {
+		klog.V(2).Infof("UDP_GRO not supported by this kernel, falling back to plain batch I/O: %v", setErr)
+		return false
+	}
+	return true
+}
+
+// gsoControlMessage 构造一条 SOL_UDP/UDP_SEGMENT 控制消息，告诉内核按 segSize
+// 切分本次 WriteBatch 里的这个大 buffer——多个等长的加密帧借此拼成一个 GSO
+// 包一次发出去，省掉中间每段各自的 IP/UDP 头。
+func gsoControlMessage(segSize int) []byte {
+	oob := make([]byte, unix.CmsgSpace(2))
+	hdr := (*unix.Cmsghdr)(unsafe.Pointer(&oob[0]))
+	hdr.Level = unix.IPPROTO_UDP
+	hdr.Type = udpSegmentCmsgType
+	hdr.SetLen(unix.CmsgLen(2))
+	binary.LittleEndian.PutUint16(oob[unix.CmsgLen(0):], uint16(segSize))
+	return oob
+}
+
+// parseGROSegmentSize 从 recvmsg 拿到的 oob 里找 UDP_GRO 的 cmsg，返回内核
+// 合并前每段的大小；没有这条 cmsg 说明这个包没被 GRO 合并，原样当一个完整帧
+// 处理就行。
+func parseGROSegmentSize(oob []byte) (int, bool) {
+	msgs, err := unix.ParseSocketControlMessage(oob)
+	if err != nil {
+		return 0, false
+	}
+	for _, m := range msgs {
+		if m.Header.Level == unix.IPPROTO_UDP && m.Header.Type == udpGROCmsgType && len(m.Data) >= 2 {
+			return int(binary.LittleEndian.Uint16(m.Data)), true
+		}
+	}
+	return 0, false
+}
+
+// outFrame 是排队等着被批量发出去的一帧：dst 是目标 UDP 端点，frame 是已经
+// 封好帧头（type byte）并加密过的完整载荷。
+type outFrame struct {
+	dst   *net.UDPAddr
+	frame []byte
+}
+
+// flushOutBatch 把攒够的一批待发帧用尽量少的系统调用发出去：gso 打开时，先把
+// 发往同一个对端、长度完全相同的连续若干帧合并成一条 UDP_SEGMENT 消息，再把
+// 所有消息（合并后的 GSO 包和剩下的单包）通过一次 WriteBatch（sendmmsg）发出去。
+func (b *batchIO) flushOutBatch(pending []outFrame) {
+	if len(pending) == 0 {
+		return
+	}
+	msgs := make([]ipv4.Message, 0, len(pending))
+	for i := 0; i < len(pending); {
+		if !b.gso {
+			msgs = append(msgs, ipv4.Message{Buffers: [][]byte{pending[i].frame}, Addr: pending[i].dst})
+			i++
+			continue
+		}
+		segSize := len(pending[i].frame)
+		maxSegs := b.batchSize
+		if maxSegs > gsoMaxSegments {
+			maxSegs = gsoMaxSegments
+		}
+		if segSize > 0 && maxSegs > gsoMaxBytes/segSize {
+			maxSegs = gsoMaxBytes / segSize
+		}
+		j := i + 1
+		for j < len(pending) && j-i < maxSegs &&
+			pending[j].dst.IP.Equal(pending[i].dst.IP) && pending[j].dst.Port == pending[i].dst.Port &&
+			len(pending[j].frame) == segSize {
+			j++
+		}
+		if j-i == 1 {
+			msgs = append(msgs, ipv4.Message{Buffers: [][]byte{pending[i].frame}, Addr: pending[i].dst})
+		} else {
+			merged := make([]byte, 0, segSize*(j-i))
+			for _, f := range pending[i:j] {
+				merged = append(merged, f.frame...)
+			}
+			msgs = append(msgs, ipv4.Message{
+				Buffers: [][]byte{merged},
+				OOB:     gsoControlMessage(segSize),
+				Addr:    pending[i].dst,
+			})
+		}
+		i = j
+	}
+	if _, err := b.pc.WriteBatch(msgs, 0); err != nil {
+		klog.V(2).Infof("udp batch write: %v", err)
+	}
+}
+
+// readInBatch 调一次 ReadBatch 收一批 UDP 包（内核层面是 recvmmsg）；开了
+// UDP_GRO 的内核会把其中一些包粘在一起送上来，按 cmsg 里报告的 segment 大小
+// 拆回原始帧，统一交给 handle 逐帧处理。
+func (b *batchIO) readInBatch(msgs []ipv4.Message, handle func(from *net.UDPAddr, frame []byte)) (int, error) {
+	n, err := b.pc.ReadBatch(msgs, 0)
+	if err != nil {
+		return n, err
+	}
+	for i := 0; i < n; i++ {
+		m := msgs[i]
+		from, _ := m.Addr.(*net.UDPAddr)
+		data := m.Buffers[0][:m.N]
+
+		segSize, grouped := 0, false
+		if b.gso && m.NN > 0 {
+			segSize, grouped = parseGROSegmentSize(m.OOB[:m.NN])
+		}
+		if !grouped || segSize <= 0 || segSize >= len(data) {
+			handle(from, data)
+			continue
+		}
+		for off := 0; off < len(data); off += segSize {
+			end := off + segSize
+			if end > len(data) {
+				end = len(data)
+			}
+			handle(from, data[off:end])
+		}
+	}
+	return n, nil
+}
+
+// tunRing 是一圈复用的缓冲区，轮流发给调用方用来 Read，避免每个包都在堆上
+// 单独分配一次。
+type tunRing struct {
+	bufs [][]byte
+	pos  int
+}
+
+func newTunRing(n, size int) *tunRing {
+	r := &tunRing{bufs: make([][]byte, n)}
+	for i := range r.bufs {
+		r.bufs[i] = make([]byte, size)
+	}
+	return r
+}
+
+func (r *tunRing) take() []byte {
+	b := r.bufs[r.pos]
+	r.pos = (r.pos + 1) % len(r.bufs)
+	return b
+}
+
+// tunToUDPBatch 是 TUN -> UDP 方向的批量转发：一个 goroutine 不停从 TUN 读包、加密
+// 后塞进 channel，另一个 goroutine 从 channel 里尽量多攒几个（不空转等待）再
+// 用一次 WriteBatch 发出去——TUN 的 Read 本身是阻塞的，没法在一次系统调用里
+// 读出多个包，攒批只能靠这种生产者/消费者管道来做。
+func tunToUDPBatch(ifce *water.Interface, conn *net.UDPConn, rt *RoutingTable, mode string, b *box, bio *batchIO) {
+	chanCap := bio.batchSize * 4
+	frames := make(chan outFrame, chanCap)
+
+	// ring 的容量必须明显大于 channel 容量：producer 最多能让 channel 塞满
+	// chanCap 个 outFrame 而不阻塞，再加上 consumer 当前正攒着的一整批，这些
+	// frame 引用的底层 buffer 在被处理完之前都不能被 producer 覆写。
+	ringSize := chanCap + bio.batchSize*2
+
+	go func() {
+		inRing := newTunRing(ringSize, maxFrameSize)
+		outRing := newTunRing(ringSize, maxFrameSize)
+		for {
+			in := inRing.take()
+			n, err := ifce.Read(in)
+			if err != nil {
+				log.Println("tun read:", err)
+				close(frames)
+				return
+			}
+			pkt := in[:n]
+			dst := innerDst(pkt)
+			p := rt.lookupByDst(dst)
+			if p == nil {
+				klog.V(4).Infof("no route for dst %s, dropping", dst)
+				continue
+			}
+			ep := p.getEndpoint()
+			if ep == nil {
+				continue // 对端端点还没发现，先丢弃
+			}
+
+			out := outRing.take()
+			sealed, err := sealForPeer(mode, b, p, out[1:1:cap(out)], pkt) // out[0] 留给帧类型字节
+			if err != nil {
+				if err != errSessionNotEstablished {
+					log.Println("seal:", err)
+					metricSealError(p.Name)
+				}
+				continue
+			}
+			out[0] = frameData
+			metricTunnelTx(p.Name, len(pkt))
+			frames <- outFrame{dst: ep, frame: out[:1+len(sealed)]}
+		}
+	}()
+
+	pending := make([]outFrame, 0, bio.batchSize)
+	for {
+		f, ok := <-frames // 阻塞等第一帧，没有待发帧的时候不空转
+		if !ok {
+			return
+		}
+		pending = append(pending[:0], f)
+	drain:
+		for len(pending) < bio.batchSize {
+			select {
+			case f, ok := <-frames:
+				if !ok {
+					break drain
+				}
+				pending = append(pending, f)
+			default:
+				break drain
+			}
+		}
+		bio.flushOutBatch(pending)
+	}
+}
+
+// udpToTUNBatch 是 UDP -> TUN 方向的批量转发：一次 ReadBatch 收一批包（GRO
+// 开着的话其中一些会在 batchIO 里被拆成多个原始帧），控制帧和数据帧从批里
+// 逐个取出处理。
+func udpToTUNBatch(ifce *water.Interface, conn *net.UDPConn, rt *RoutingTable, mode string, b *box, localKey StaticKeypair, bio *batchIO) {
+	// 开了 GRO 时内核可能把多个帧粘成一个最大 gsoMaxBytes 的包送上来，接收
+	// 缓冲区只装得下一帧的话，超出的部分会被截断丢掉。
+	rxBufSize := maxFrameSize
+	if bio.gso {
+		rxBufSize = gsoMaxBytes
+	}
+	msgs := make([]ipv4.Message, bio.batchSize)
+	for i := range msgs {
+		msgs[i].Buffers = [][]byte{make([]byte, rxBufSize)}
+		msgs[i].OOB = make([]byte, unix.CmsgSpace(2))
+	}
+	plainBuf := make([]byte, maxFrameSize) // ifce.Write 是同步的，批内逐帧写完才会复用，安全
+
+	handle := func(from *net.UDPAddr, raw []byte) {
+		if len(raw) < 1 {
+			return
+		}
+		typ := raw[0]
+		payload := raw[1:]
+		switch typ {
+		case frameHello:
+			handleHello(conn, rt, from, payload)
+		case frameHelloAck:
+			handleHelloAck(rt, from, payload)
+		case frameHSInit:
+			handleHandshakeInit(conn, rt, localKey, from, payload)
+		case frameHSResp:
+			handleHandshakeResp(rt, localKey, from, payload)
+		case frameData:
+			plain, peer, err := openForPeer(mode, b, rt, from, plainBuf[:0], payload)
+			if err != nil {
+				if err != errSessionNotEstablished {
+					klog.V(4).Infof("open from %s failed: %v", from, err)
+					metricOpenError(peerNameOrUnknown(peer))
+				}
+				return
+			}
+			if src := innerSrc(plain); src != nil {
+				if p := rt.lookupBySrc(src); p != nil {
+					p.updateEndpoint(from) // 漫游：源端口/IP 变了就跟着更新
+				}
+			}
+			metricTunnelRx(peerNameOrUnknown(peer), len(plain))
+			if _, err := ifce.Write(plain); err != nil {
+				log.Println("tun write:", err)
+			}
+		default:
+			klog.V(4).Infof("unknown frame type 0x%02x from %s", typ, from)
+		}
+	}
+
+	for {
+		if _, err := bio.readInBatch(msgs, handle); err != nil {
+			log.Println("udp batch read:", err)
+			return
+		}
+	}
+}
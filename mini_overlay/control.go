@@ -0,0 +1,54 @@
+// cmd/mini-overlay/control.go
+//
+// -metrics 开启时跑的调试/可观测性 HTTP server：/metrics 给 Prometheus 抓取，
+// /peers 给人或脚本看当前 mesh 状态，/debug/pprof 留着排查 CPU/内存/goroutine
+// 问题用。只监听在调用方给的地址上，不和隧道本身的 UDP 监听共用端口。
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/pprof"
+
+	"github.com/HaojieZhang6848/network_learning/netinspect"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"k8s.io/klog/v2"
+)
+
+// peersResponse 是 /peers 的响应体：每个 peer 的状态快照，外加本机 TUN/TAP
+// 设备自身的 netinspect 信息，方便一眼看出"隧道建起来了但底层链路有问题"。
+type peersResponse struct {
+	Peers []peerStatus       `json:"peers"`
+	Iface *netinspect.IfInfo `json:"iface,omitempty"`
+}
+
+// serveControl 启动调试/可观测性 HTTP server，阻塞直到出错；调用方以
+// goroutine 方式启动它，失败不应该影响隧道主流程。
+func serveControl(addr string, rt *RoutingTable, ifaceName string) {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.Handler())
+	mux.HandleFunc("/peers", func(w http.ResponseWriter, r *http.Request) {
+		peers := rt.all()
+		resp := peersResponse{Peers: make([]peerStatus, 0, len(peers))}
+		for _, p := range peers {
+			resp.Peers = append(resp.Peers, p.status())
+		}
+		if info, err := netinspect.Inspect(ifaceName); err == nil {
+			resp.Iface = &info
+		}
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(resp); err != nil {
+			klog.V(4).Infof("/peers encode: %v", err)
+		}
+	})
+	mux.HandleFunc("/debug/pprof/", pprof.Index)
+	mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+
+	klog.Infof("control server listening on %s (/metrics, /peers, /debug/pprof)", addr)
+	if err := http.ListenAndServe(addr, mux); err != nil {
+		klog.Warningf("control server stopped: %v", err)
+	}
+}
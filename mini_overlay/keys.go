@@ -0,0 +1,104 @@
+// cmd/mini-overlay/keys.go
+package main
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"fmt"
+	"os"
+	"strings"
+
+	"golang.org/x/crypto/curve25519"
+)
+
+// StaticKeypair is a long-term Curve25519 identity used by the Noise-IK
+// handshake (see noise.go). It plays the same role as a WireGuard
+// private/public keypair.
+type StaticKeypair struct {
+	priv [32]byte
+	pub  [32]byte
+}
+
+func (k StaticKeypair) PublicB64() string {
+	return base64.StdEncoding.EncodeToString(k.pub[:])
+}
+
+func generateStaticKeypair() (StaticKeypair, error) {
+	var k StaticKeypair
+	if _, err := rand.Read(k.priv[:]); err != nil {
+		return k, err
+	}
+	// clamp, 和 X25519 的标准做法一致
+	k.priv[0] &= 248
+	k.priv[31] &= 127
+	k.priv[31] |= 64
+	pub, err := curve25519.X25519(k.priv[:], curve25519.Basepoint)
+	if err != nil {
+		return k, err
+	}
+	copy(k.pub[:], pub)
+	return k, nil
+}
+
+func keypairFromPrivB64(privB64 string) (StaticKeypair, error) {
+	var k StaticKeypair
+	raw, err := base64.StdEncoding.DecodeString(strings.TrimSpace(privB64))
+	if err != nil {
+		return k, fmt.Errorf("bad base64 private key: %w", err)
+	}
+	if len(raw) != 32 {
+		return k, fmt.Errorf("private key must be 32 bytes, got %d", len(raw))
+	}
+	copy(k.priv[:], raw)
+	pub, err := curve25519.X25519(k.priv[:], curve25519.Basepoint)
+	if err != nil {
+		return k, err
+	}
+	copy(k.pub[:], pub)
+	return k, nil
+}
+
+// loadOrGenerateStaticKeypair loads a static keypair from a private-key flag
+// (base64) or a private-key file. If a file path is given but doesn't exist
+// yet, a fresh keypair is generated and saved there; if neither is supplied, a
+// fresh keypair is generated and not saved anywhere.
+func loadOrGenerateStaticKeypair(privB64, privFile string) (StaticKeypair, error) {
+	if privB64 != "" {
+		return keypairFromPrivB64(privB64)
+	}
+	if privFile == "" {
+		return generateStaticKeypair()
+	}
+	raw, err := os.ReadFile(privFile)
+	if err == nil {
+		return keypairFromPrivB64(string(raw))
+	}
+	if !os.IsNotExist(err) {
+		return StaticKeypair{}, fmt.Errorf("read private key file: %w", err)
+	}
+	k, err := generateStaticKeypair()
+	if err != nil {
+		return k, err
+	}
+	if err := os.WriteFile(privFile, []byte(k.PrivB64()+"\n"), 0600); err != nil {
+		return k, fmt.Errorf("persist generated private key: %w", err)
+	}
+	return k, nil
+}
+
+func (k StaticKeypair) PrivB64() string {
+	return base64.StdEncoding.EncodeToString(k.priv[:])
+}
+
+func parsePubKeyB64(b64 string) ([32]byte, error) {
+	var pub [32]byte
+	raw, err := base64.StdEncoding.DecodeString(strings.TrimSpace(b64))
+	if err != nil {
+		return pub, fmt.Errorf("bad base64 public key: %w", err)
+	}
+	if len(raw) != 32 {
+		return pub, fmt.Errorf("public key must be 32 bytes, got %d", len(raw))
+	}
+	copy(pub[:], raw)
+	return pub, nil
+}
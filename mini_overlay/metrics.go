@@ -0,0 +1,118 @@
+// cmd/mini-overlay/metrics.go
+//
+// Prometheus 指标：-metrics 开启后通过 control.go 里的 HTTP server 在 /metrics
+// 暴露。这里只放指标定义和一组小的 metricXxx 助手函数，调用方（握手、收发
+// 路径）不需要知道 Prometheus 的 API，出错或者忘了打点也不影响功能。
+package main
+
+import (
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	metricBytesTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "mini_overlay_bytes_total",
+		Help: "Bytes processed on the tunnel data path, by peer and direction.",
+	}, []string{"peer", "direction"}) // direction: "rx" | "tx"
+
+	metricPacketsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "mini_overlay_packets_total",
+		Help: "Packets processed on the tunnel data path, by peer and direction.",
+	}, []string{"peer", "direction"})
+
+	metricSealErrorsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "mini_overlay_seal_errors_total",
+		Help: "Errors encrypting an outgoing packet for a peer (excludes the routine no-session-yet case).",
+	}, []string{"peer"})
+
+	metricOpenErrorsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "mini_overlay_open_errors_total",
+		Help: "Errors decrypting an incoming packet (excludes the routine no-session-yet case).",
+	}, []string{"peer"})
+
+	metricHandshakeAttemptsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "mini_overlay_handshake_attempts_total",
+		Help: "Noise-IK handshakes initiated, by peer.",
+	}, []string{"peer"})
+
+	metricHandshakeFailuresTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "mini_overlay_handshake_failures_total",
+		Help: "Noise-IK handshakes that failed on either side, by peer (\"unknown\" if the failure happened before the peer could be identified).",
+	}, []string{"peer"})
+
+	metricHandshakeSuccessTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "mini_overlay_handshake_success_total",
+		Help: "Noise-IK handshakes that completed successfully, by peer.",
+	}, []string{"peer"})
+
+	metricPeerEndpointInfo = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "mini_overlay_peer_endpoint_info",
+		Help: "Always 1; labels carry the peer's current UDP endpoint (value changes on roam, label set does not reset).",
+	}, []string{"peer", "endpoint"})
+
+	metricPeerLastHandshakeSeconds = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "mini_overlay_peer_last_handshake_seconds",
+		Help: "Unix time of the last successfully established session with this peer.",
+	}, []string{"peer"})
+
+	metricPeerRTTSeconds = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "mini_overlay_peer_rtt_seconds",
+		Help: "Most recent round-trip time measured via hello/hello-ack control frames.",
+	}, []string{"peer"})
+)
+
+func init() {
+	prometheus.MustRegister(
+		metricBytesTotal,
+		metricPacketsTotal,
+		metricSealErrorsTotal,
+		metricOpenErrorsTotal,
+		metricHandshakeAttemptsTotal,
+		metricHandshakeFailuresTotal,
+		metricHandshakeSuccessTotal,
+		metricPeerEndpointInfo,
+		metricPeerLastHandshakeSeconds,
+		metricPeerRTTSeconds,
+	)
+}
+
+func metricTunnelTx(peer string, n int) {
+	metricBytesTotal.WithLabelValues(peer, "tx").Add(float64(n))
+	metricPacketsTotal.WithLabelValues(peer, "tx").Inc()
+}
+
+func metricTunnelRx(peer string, n int) {
+	metricBytesTotal.WithLabelValues(peer, "rx").Add(float64(n))
+	metricPacketsTotal.WithLabelValues(peer, "rx").Inc()
+}
+
+func metricSealError(peer string) {
+	metricSealErrorsTotal.WithLabelValues(peer).Inc()
+}
+
+func metricOpenError(peer string) {
+	metricOpenErrorsTotal.WithLabelValues(peer).Inc()
+}
+
+func metricHandshakeAttempt(peer string) {
+	metricHandshakeAttemptsTotal.WithLabelValues(peer).Inc()
+}
+
+func metricHandshakeFailure(peer string) {
+	metricHandshakeFailuresTotal.WithLabelValues(peer).Inc()
+}
+
+func metricHandshakeSuccess(peer string) {
+	metricHandshakeSuccessTotal.WithLabelValues(peer).Inc()
+	metricPeerLastHandshakeSeconds.WithLabelValues(peer).Set(float64(time.Now().Unix()))
+}
+
+func metricPeerEndpoint(peer, endpoint string) {
+	metricPeerEndpointInfo.WithLabelValues(peer, endpoint).Set(1)
+}
+
+func metricPeerRTT(peer string, d time.Duration) {
+	metricPeerRTTSeconds.WithLabelValues(peer).Set(d.Seconds())
+}
@@ -4,6 +4,8 @@ package main
 import (
 	cryptoRand "crypto/rand"
 	"encoding/base64"
+	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
 	"io"
@@ -12,18 +14,322 @@ import (
 	"os"
 	"os/exec"
 	"os/signal"
+	"strings"
+	"sync"
 	"syscall"
+	"time"
 
+	"github.com/HaojieZhang6848/network_learning/netinspect"
 	"github.com/songgao/water"
 	"golang.org/x/crypto/nacl/secretbox"
+	"gopkg.in/yaml.v3"
 	"k8s.io/klog/v2"
 )
 
 const (
 	// 尽量避免外层碎片：1300 作为内层 MTU（留出 UDP+IP+加密开销）
 	innerMTU = 1300
+
+	// 控制帧类型（1 字节版本化 type byte，payload 跟在后面）
+	frameData     byte = 0x01 // 载荷是一个被加密的内层 IP 包
+	frameHello    byte = 0x02 // 发现/保活：载荷是一个 helloPayload 的 JSON
+	frameHSInit   byte = 0x03 // Noise-IK 握手第一条消息
+	frameHSResp   byte = 0x04 // Noise-IK 握手第二条消息
+	frameHelloAck byte = 0x05 // 对 hello 的回执：原样带回发送时间戳，用来量 RTT
+
+	keepaliveInterval  = 10 * time.Second
+	reresolveInterval  = 30 * time.Second
+	peerStaleAfter     = 3 * time.Minute
+	handshakeRetryTick = 1 * time.Second
 )
 
+// Peer 是 mesh 中的一个对端：通过隧道内侧的 IP/CIDR 寻址，UDP 端点可能因为
+// NAT 穿透、漫游或 DNS 解析而随时间变化，所以这里用锁保护。
+type Peer struct {
+	Name      string
+	CIDR      *net.IPNet
+	PubKeyB64 string   // noise 模式下对端的静态公钥（base64），psk 模式下不使用
+	staticPub [32]byte // PubKeyB64 解码后的形式，noise 模式下才有效
+
+	// session 在 -mode noise 时非空，承载握手状态机和收发会话密钥。
+	// psk 模式继续用所有 peer 共享的同一个 box，不需要每个 peer 一个 session。
+	session *Session
+
+	mu              sync.RWMutex
+	endpoint        *net.UDPAddr // 当前已知/学习到的端点，可能为 nil
+	endpointHost    string       // 配置里写的 host:port（可能是域名），用于周期性重新解析
+	lastSeen        time.Time
+	lastHandshakeAt time.Time     // noise 模式下最近一次握手建立会话的时间，psk 模式下一直是零值
+	rtt             time.Duration // 最近一次 hello/hello-ack 往返测出来的 RTT
+}
+
+func (p *Peer) getEndpoint() *net.UDPAddr {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	return p.endpoint
+}
+
+// updateEndpoint 记录对端的最新 UDP 端点（来自发现帧或者漫游）。
+func (p *Peer) updateEndpoint(addr *net.UDPAddr) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	metricPeerEndpoint(p.Name, addr.String())
+	if p.endpoint == nil || !p.endpoint.IP.Equal(addr.IP) || p.endpoint.Port != addr.Port {
+		klog.Infof("peer %s endpoint -> %s", p.Name, addr)
+	}
+	p.endpoint = addr
+	p.lastSeen = time.Now()
+}
+
+// markHandshakeEstablished 记录一次（重新）握手成功建立会话的时间，仅在
+// -mode noise 下有调用方会触达。
+func (p *Peer) markHandshakeEstablished() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.lastHandshakeAt = time.Now()
+	metricHandshakeSuccess(p.Name)
+}
+
+// updateRTT 记录一次 hello/hello-ack 往返量出来的 RTT。
+func (p *Peer) updateRTT(d time.Duration) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.rtt = d
+	metricPeerRTT(p.Name, d)
+}
+
+// status 是 /peers 调试端点用的快照，字段都是 JSON 友好的值类型。
+type peerStatus struct {
+	Name            string  `json:"name"`
+	CIDR            string  `json:"cidr"`
+	Endpoint        string  `json:"endpoint,omitempty"`
+	LastSeen        string  `json:"last_seen,omitempty"`
+	LastHandshake   string  `json:"last_handshake,omitempty"`
+	RTTMilliseconds float64 `json:"rtt_ms,omitempty"`
+}
+
+func (p *Peer) status() peerStatus {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	st := peerStatus{Name: p.Name}
+	if p.CIDR != nil {
+		st.CIDR = p.CIDR.String()
+	}
+	if p.endpoint != nil {
+		st.Endpoint = p.endpoint.String()
+	}
+	if !p.lastSeen.IsZero() {
+		st.LastSeen = p.lastSeen.UTC().Format(time.RFC3339)
+	}
+	if !p.lastHandshakeAt.IsZero() {
+		st.LastHandshake = p.lastHandshakeAt.UTC().Format(time.RFC3339)
+	}
+	if p.rtt > 0 {
+		st.RTTMilliseconds = float64(p.rtt) / float64(time.Millisecond)
+	}
+	return st
+}
+
+func (p *Peer) stale() bool {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	return p.endpoint != nil && time.Since(p.lastSeen) > peerStaleAfter
+}
+
+// PeerConfig 是 -peers 配置文件里的一条记录（YAML 或 JSON）。
+type PeerConfig struct {
+	Name     string `json:"name" yaml:"name"`
+	CIDR     string `json:"cidr" yaml:"cidr"`
+	Endpoint string `json:"endpoint" yaml:"endpoint"`
+	PubKey   string `json:"pubkey" yaml:"pubkey"`
+}
+
+func loadPeerConfigs(path string) ([]PeerConfig, error) {
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var cfgs []PeerConfig
+	if strings.HasSuffix(path, ".json") {
+		err = json.Unmarshal(raw, &cfgs)
+	} else {
+		err = yaml.Unmarshal(raw, &cfgs)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("parse peers config: %w", err)
+	}
+	return cfgs, nil
+}
+
+// newPeer 根据配置构造一个 Peer。endpoint 字段可以是 host:port（含域名）也可以
+// 留空——留空表示"等对方先发现我"，端点会在收到它的 hello 帧后学习到。
+func newPeer(c PeerConfig) (*Peer, error) {
+	_, cidr, err := net.ParseCIDR(c.CIDR)
+	if err != nil {
+		return nil, fmt.Errorf("peer %s: bad cidr %q: %w", c.Name, c.CIDR, err)
+	}
+	p := &Peer{
+		Name:         c.Name,
+		CIDR:         cidr,
+		PubKeyB64:    c.PubKey,
+		endpointHost: c.Endpoint,
+		session:      &Session{},
+	}
+	if c.PubKey != "" {
+		pub, err := parsePubKeyB64(c.PubKey)
+		if err != nil {
+			return nil, fmt.Errorf("peer %s: %w", c.Name, err)
+		}
+		p.staticPub = pub
+	}
+	if c.Endpoint != "" {
+		if addr, err := net.ResolveUDPAddr("udp", c.Endpoint); err == nil {
+			p.endpoint = addr
+		} else {
+			klog.Warningf("peer %s: initial resolve of %q failed, will retry: %v", c.Name, c.Endpoint, err)
+		}
+	}
+	return p, nil
+}
+
+// RoutingTable 按内层目的地址做最长前缀匹配，选出应该转发到的对端。
+type RoutingTable struct {
+	mu    sync.RWMutex
+	peers []*Peer
+}
+
+func (rt *RoutingTable) set(peers []*Peer) {
+	rt.mu.Lock()
+	rt.peers = peers
+	rt.mu.Unlock()
+}
+
+func (rt *RoutingTable) all() []*Peer {
+	rt.mu.RLock()
+	defer rt.mu.RUnlock()
+	out := make([]*Peer, len(rt.peers))
+	copy(out, rt.peers)
+	return out
+}
+
+// lookupByDst 返回内层目的 IP 的最长前缀匹配对端。
+func (rt *RoutingTable) lookupByDst(dst net.IP) *Peer {
+	rt.mu.RLock()
+	defer rt.mu.RUnlock()
+	var best *Peer
+	bestLen := -1
+	for _, p := range rt.peers {
+		if p.CIDR == nil || dst == nil || !p.CIDR.Contains(dst) {
+			continue
+		}
+		ones, _ := p.CIDR.Mask.Size()
+		if ones > bestLen {
+			bestLen = ones
+			best = p
+		}
+	}
+	return best
+}
+
+// lookupBySrc 用于漫游/发现：收到的内层包的源地址落在哪个对端的 CIDR 里。
+func (rt *RoutingTable) lookupBySrc(src net.IP) *Peer {
+	return rt.lookupByDst(src)
+}
+
+func (rt *RoutingTable) byName(name string) *Peer {
+	rt.mu.RLock()
+	defer rt.mu.RUnlock()
+	for _, p := range rt.peers {
+		if p.Name == name {
+			return p
+		}
+	}
+	return nil
+}
+
+func (rt *RoutingTable) byStaticPub(pub [32]byte) *Peer {
+	rt.mu.RLock()
+	defer rt.mu.RUnlock()
+	for _, p := range rt.peers {
+		if constantTimeEqual32(p.staticPub, pub) {
+			return p
+		}
+	}
+	return nil
+}
+
+// byEndpoint 按当前已知端点匹配 peer，用来把一条握手回应帧归属到发起它的 peer。
+func (rt *RoutingTable) byEndpoint(addr *net.UDPAddr) *Peer {
+	rt.mu.RLock()
+	defer rt.mu.RUnlock()
+	for _, p := range rt.peers {
+		if ep := p.getEndpoint(); ep != nil && ep.IP.Equal(addr.IP) && ep.Port == addr.Port {
+			return p
+		}
+	}
+	return nil
+}
+
+// innerDst 从内层 IPv4/IPv6 包头里取出目的地址。
+func innerDst(pkt []byte) net.IP {
+	if len(pkt) < 1 {
+		return nil
+	}
+	switch pkt[0] >> 4 {
+	case 4:
+		if len(pkt) < 20 {
+			return nil
+		}
+		return net.IP(pkt[16:20])
+	case 6:
+		if len(pkt) < 40 {
+			return nil
+		}
+		return net.IP(pkt[24:40])
+	}
+	return nil
+}
+
+// innerSrc 从内层 IPv4/IPv6 包头里取出源地址。
+func innerSrc(pkt []byte) net.IP {
+	if len(pkt) < 1 {
+		return nil
+	}
+	switch pkt[0] >> 4 {
+	case 4:
+		if len(pkt) < 20 {
+			return nil
+		}
+		return net.IP(pkt[12:16])
+	case 6:
+		if len(pkt) < 40 {
+			return nil
+		}
+		return net.IP(pkt[8:24])
+	}
+	return nil
+}
+
+// helloPayload 是发现/保活控制帧的内容：版本化，方便以后扩展字段。
+// Name 是发送方自己的身份（-name，或者 -peer 点对点模式下固定的
+// "default"），不是发送方认为的对方名字——接收方靠它在自己的 peer 表里
+// 反查是谁发来的包，这样才能学到 NAT 转换后/此前未知的端点。
+// SentUnixNano 是发送方发出时的本地时间（UnixNano），收到方原样塞进
+// frameHelloAck 带回去，用来在发送方那一侧量 RTT，不要求两端时钟同步。
+type helloPayload struct {
+	Version      byte   `json:"v"`
+	Name         string `json:"name"`
+	SentUnixNano int64  `json:"sent_unix_nano,omitempty"`
+}
+
+// helloAckPayload 是对一条 hello 帧的回执：原样带回对方的发送时间戳。
+type helloAckPayload struct {
+	Version      byte  `json:"v"`
+	SentUnixNano int64 `json:"sent_unix_nano"`
+}
+
+const helloVersion byte = 1
+
 type box struct {
 	key    [32]byte
 	enable bool
@@ -62,36 +368,146 @@ func must(err error) {
 	}
 }
 
+// logInterfaceDiagnostics 用 netinspect 打印一下刚创建的 TUN/TAP 设备自身，
+// 以及承载 UDP 流量的默认出口网卡，方便排查"隧道建起来了但底层链路有问题"
+// 这类问题，不应该影响主流程，所以任何错误都只是记一条日志。
+func logInterfaceDiagnostics(tunName string) {
+	if info, err := netinspect.Inspect(tunName); err != nil {
+		klog.V(2).Infof("netinspect %s: %v", tunName, err)
+	} else {
+		klog.Infof("netinspect %s: type=%s mtu=%d state=%s", info.Name, info.Type, info.MTU, info.OperState)
+	}
+
+	uplink, err := defaultRouteInterface()
+	if err != nil {
+		klog.V(2).Infof("detect uplink: %v", err)
+		return
+	}
+	if info, err := netinspect.Inspect(uplink); err != nil {
+		klog.V(2).Infof("netinspect uplink %s: %v", uplink, err)
+	} else {
+		klog.Infof("netinspect uplink %s: type=%s driver=%s state=%s", info.Name, info.Type, info.Driver, info.OperState)
+	}
+}
+
+// defaultRouteInterface 读 /proc/net/route 找默认路由（目的地址 00000000）
+// 走的网卡名字，用来定位 UDP 流量实际会经由哪块物理/上联网卡发出去。
+func defaultRouteInterface() (string, error) {
+	raw, err := os.ReadFile("/proc/net/route")
+	if err != nil {
+		return "", err
+	}
+	lines := strings.Split(strings.TrimSpace(string(raw)), "\n")
+	for _, line := range lines[1:] { // 第一行是表头
+		fields := strings.Fields(line)
+		if len(fields) < 2 {
+			continue
+		}
+		if fields[1] == "00000000" {
+			return fields[0], nil
+		}
+	}
+	return "", fmt.Errorf("no default route found in /proc/net/route")
+}
+
+var errSessionNotEstablished = errors.New("session not established")
+
+// peerNameOrUnknown 是指标打点用的小助手：psk 模式下 openForPeer 常常拿不到
+// peer（没有按 peer 区分会话），不能让这种情况下的指标标签是个空字符串。
+func peerNameOrUnknown(p *Peer) string {
+	if p == nil {
+		return "unknown"
+	}
+	return p.Name
+}
+
+// sealForPeer 按当前加密模式把一个明文包（L3 的 IP 包或者 L2 的以太网帧）
+// 加密成发给某个 peer 的载荷。noise 模式下要求该 peer 的会话已经建立（rekey
+// 进行中也算，旧密钥在新握手完成前仍然有效）。dst 是
+// 调用方提供的复用缓冲区，传 nil 等价于每次都新分配（兼容非批量调用方）。
+func sealForPeer(mode string, b *box, p *Peer, dst, pkt []byte) ([]byte, error) {
+	if mode == "noise" {
+		if st := p.session.getState(); st != StateEstablished && st != StateRekeying {
+			return nil, errSessionNotEstablished
+		}
+		return p.session.seal(dst, pkt)
+	}
+	return b.seal(dst, pkt)
+}
+
+// openForPeer 解密一个来自 from 的载荷，noise 模式下按来源端点找到对应 peer
+// 的会话，psk 模式下用共享密钥。返回解密后的明文和负责这份载荷的 peer
+// （psk 模式下没有每个 peer 的会话，peer 可能是 nil，调用方要另行判断来源）。
+// dst 规则同 sealForPeer。
+func openForPeer(mode string, b *box, rt *RoutingTable, from *net.UDPAddr, dst, payload []byte) (plain []byte, peer *Peer, err error) {
+	if mode == "noise" {
+		p := rt.byEndpoint(from)
+		if p == nil {
+			return nil, nil, errSessionNotEstablished
+		}
+		if st := p.session.getState(); st != StateEstablished && st != StateRekeying {
+			return nil, p, errSessionNotEstablished
+		}
+		plain, err = p.session.open(dst, payload)
+		return plain, p, err
+	}
+	plain, ok := b.open(dst, payload)
+	if !ok {
+		return nil, nil, fmt.Errorf("secretbox open failed")
+	}
+	return plain, nil, nil
+}
+
 func main() {
 	var (
-		ifCIDR = flag.String("cidr", "192.168.124.1/24", "virtual interface CIDR (e.g. 192.168.124.1/24)")
-		local  = flag.String("local", ":51820", "local UDP addr (host:port)")
-		peer   = flag.String("peer", "", "peer UDP addr (host:port)")
-		pskB64 = flag.String("psk", "", "base64 32-byte pre-shared key (optional)")
-		ifName = flag.String("ifname", "", "TUN name (optional)")
+		ifCIDR    = flag.String("cidr", "192.168.124.1/24", "virtual interface CIDR (e.g. 192.168.124.1/24)")
+		local     = flag.String("local", ":51820", "local UDP addr (host:port)")
+		peer      = flag.String("peer", "", "single peer UDP addr (host:port), legacy point-to-point mode")
+		peersFile = flag.String("peers", "", "path to YAML/JSON mesh peer list ({name,cidr,endpoint,pubkey})")
+		selfName  = flag.String("name", "", "this node's own identity, as named in the other peers' -peers config; required for -mode psk / mesh discovery of unknown endpoints (defaults to \"default\" in legacy -peer mode)")
+		pskB64    = flag.String("psk", "", "base64 32-byte pre-shared key (optional)")
+		ifName    = flag.String("ifname", "", "TUN name (optional)")
+		mode      = flag.String("mode", "psk", "encryption mode: psk (static secretbox key) or noise (Noise-IK handshake, rotating session keys)")
+		privB64   = flag.String("privkey", "", "base64 32-byte Curve25519 static private key (noise mode)")
+		privFile  = flag.String("privkey-file", "", "path to a file holding the base64 static private key; generated and saved here if absent (noise mode)")
+		iftype    = flag.String("iftype", "tun", "tunnel link layer: tun (L3 routing) or tap (L2 learning bridge)")
+		floodPPS  = flag.Float64("flood-pps", 200, "tap mode: per-peer rate limit (packets/sec) for flooded broadcast/multicast/unknown-unicast frames")
+		batchSize = flag.Int("batch-size", defaultBatchSize, "tun mode: max packets per sendmmsg/recvmmsg batch")
+		gso       = flag.Bool("gso", true, "tun mode: opportunistically use UDP_SEGMENT/UDP_GRO (GSO/GRO) batching when the kernel supports it")
+		metrics   = flag.String("metrics", "", "address (host:port) to serve Prometheus /metrics, /peers and /debug/pprof on; empty disables it")
 	)
 	flag.Parse()
 	klog.Info("mini-overlay starting...")
 
-	// 初始化 TUN
-	cfg := water.Config{DeviceType: water.TUN}
+	if *iftype != "tun" && *iftype != "tap" {
+		log.Fatalf("unknown -iftype %q, want tun or tap", *iftype)
+	}
+
+	// 初始化 TUN/TAP
+	devType := water.DeviceType(water.TUN)
+	if *iftype == "tap" {
+		devType = water.TAP
+	}
+	cfg := water.Config{DeviceType: devType}
 	if *ifName != "" {
 		cfg.Name = *ifName
 	}
 	ifce, err := water.New(cfg)
 	must(err)
-	klog.Info("TUN:", ifce.Name())
-
-	// 自动配置 TUN IP/MTU
-	klog.Infof("Configuring TUN interface %s with %s and MTU %d...", ifce.Name(), *ifCIDR, innerMTU)
+	klog.Infof("%s: %s", *iftype, ifce.Name())
+	logInterfaceDiagnostics(ifce.Name())
 
-	// 添加 IP 地址
-	cmd1 := exec.Command("ip", "addr", "add", *ifCIDR, "dev", ifce.Name())
-	if err := cmd1.Run(); err != nil {
-		log.Printf("Failed to add IP address: %v", err)
-		klog.Infof("Please run manually: sudo ip addr add %s dev %s", *ifCIDR, ifce.Name())
-	} else {
-		klog.Infof("IP address %s added to %s", *ifCIDR, ifce.Name())
+	// 自动配置接口 IP/MTU。tap 模式通常会被挂到一个 Linux 网桥上，不在这里分配
+	// 三层地址，留给用户或者上层编排来做。
+	if *iftype == "tun" {
+		klog.Infof("Configuring TUN interface %s with %s and MTU %d...", ifce.Name(), *ifCIDR, innerMTU)
+		cmd1 := exec.Command("ip", "addr", "add", *ifCIDR, "dev", ifce.Name())
+		if err := cmd1.Run(); err != nil {
+			log.Printf("Failed to add IP address: %v", err)
+			klog.Infof("Please run manually: sudo ip addr add %s dev %s", *ifCIDR, ifce.Name())
+		} else {
+			klog.Infof("IP address %s added to %s", *ifCIDR, ifce.Name())
+		}
 	}
 
 	// 设置接口状态为 up 并配置 MTU
@@ -113,83 +529,318 @@ func main() {
 	defer conn.Close()
 	klog.Info("UDP listen on", conn.LocalAddr())
 
-	var raddr *net.UDPAddr
-	if *peer != "" {
-		raddr, err = net.ResolveUDPAddr("udp", *peer)
+	// 构建路由表：优先用 -peers 的 mesh 配置，否则退化为 -peer 的点对点模式
+	// （单一对端，0.0.0.0/0 兜底路由，保持旧用法兼容）。
+	rt := &RoutingTable{}
+	switch {
+	case *peersFile != "":
+		cfgs, err := loadPeerConfigs(*peersFile)
+		must(err)
+		peers := make([]*Peer, 0, len(cfgs))
+		for _, c := range cfgs {
+			p, err := newPeer(c)
+			must(err)
+			peers = append(peers, p)
+			klog.Infof("mesh peer %q cidr=%s endpoint=%s", p.Name, p.CIDR, c.Endpoint)
+		}
+		rt.set(peers)
+	case *peer != "":
+		raddr, err := net.ResolveUDPAddr("udp", *peer)
 		must(err)
-		klog.Info("Peer:", raddr.String())
+		_, all4, _ := net.ParseCIDR("0.0.0.0/0")
+		rt.set([]*Peer{{Name: "default", CIDR: all4, endpoint: raddr, endpointHost: *peer, session: &Session{}}})
+		klog.Info("Peer (legacy point-to-point):", raddr.String())
+	default:
+		klog.Info("No peers configured; will learn peers purely via inbound hello frames")
+	}
+
+	// selfID 是本节点在 hello 帧里用来自报身份的名字：mesh 模式下必须和对端
+	// -peers 配置里给这个节点起的名字一致，否则对方的 rt.byName 永远查不到、
+	// 学不到经 NAT 转换过的端点；legacy -peer 模式双方都把唯一对端叫
+	// "default"，保持这个默认值不破坏旧用法。
+	selfID := *selfName
+	if selfID == "" {
+		if *peer != "" {
+			selfID = "default"
+		} else {
+			klog.Warning("-name not set; inbound hello frames from mesh peers will not be able to identify this node")
+		}
 	}
 
-	// 预共享密钥（可选）
-	var b box
-	if *pskB64 != "" {
-		raw, err := base64.StdEncoding.DecodeString(*pskB64)
+	var b box                  // -mode psk
+	var localKey StaticKeypair // -mode noise
+	switch *mode {
+	case "psk":
+		if *pskB64 != "" {
+			raw, err := base64.StdEncoding.DecodeString(*pskB64)
+			must(err)
+			if len(raw) != 32 {
+				log.Fatalf("psk length must be 32, got %d", len(raw))
+			}
+			copy(b.key[:], raw)
+			b.enable = true
+			klog.Info("Encryption: secretbox (psk) enabled")
+		} else {
+			klog.Info("Encryption: disabled (PSK not provided)")
+		}
+	case "noise":
+		var err error
+		localKey, err = loadOrGenerateStaticKeypair(*privB64, *privFile)
 		must(err)
-		if len(raw) != 32 {
-			log.Fatalf("psk length must be 32, got %d", len(raw))
+		klog.Infof("Encryption: Noise-IK enabled, local public key = %s", localKey.PublicB64())
+		for _, p := range rt.all() {
+			if p.PubKeyB64 == "" {
+				log.Fatalf("peer %s has no pubkey, required for -mode noise", p.Name)
+			}
 		}
-		copy(b.key[:], raw)
-		b.enable = true
-		klog.Info("Encryption: secretbox enabled")
-	} else {
-		klog.Info("Encryption: disabled (PSK not provided)")
+	default:
+		log.Fatalf("unknown -mode %q, want psk or noise", *mode)
+	}
+
+	if *metrics != "" {
+		go serveControl(*metrics, rt, ifce.Name())
 	}
 
 	// ctrl+c 退出
 	stop := make(chan os.Signal, 1)
 	signal.Notify(stop, syscall.SIGINT, syscall.SIGTERM)
 
-	// 从 TUN -> UDP
-	go func() {
-		buf := make([]byte, 1<<16)
-		out := make([]byte, 0, 1<<16)
-		for {
-			n, err := ifce.Read(buf)
-			if err != nil {
-				log.Println("tun read:", err)
-				return
-			}
-			pkt := buf[:n]
-			out = out[:0]
-			sealed, err := b.seal(out, pkt)
-			if err != nil {
-				log.Println("seal:", err)
-				continue
-			}
-			if raddr == nil {
-				continue // 没配置对端就不发
-			}
-			if _, err := conn.WriteToUDP(sealed, raddr); err != nil {
-				log.Println("udp write:", err)
+	if *mode == "noise" {
+		go handshakeLoop(conn, rt, localKey, stop)
+	}
+
+	// 对 DNS 命名的端点做周期性重新解析，应对对端 IP 变化（动态 DNS/重启）。
+	go reresolveLoop(rt, stop)
+
+	// 周期性向已知/待发现的对端发送 hello 控制帧，驱动 NAT 打洞和端点发现。
+	go keepaliveLoop(conn, rt, selfID, stop)
+
+	if *iftype == "tap" {
+		macTable := newMACTable()
+		flood := newFloodLimiters(*floodPPS)
+		go tapToUDP(ifce, conn, rt, *mode, &b, macTable, flood)
+		go udpToTAP(ifce, conn, rt, *mode, &b, localKey, macTable)
+	} else {
+		bio := newBatchIO(conn, *batchSize, *gso)
+		go tunToUDPBatch(ifce, conn, rt, *mode, &b, bio)
+		go udpToTUNBatch(ifce, conn, rt, *mode, &b, localKey, bio)
+	}
+
+	<-stop
+	klog.Info("Bye.")
+}
+
+// handleHello 处理发现/保活帧：payload 里的 Name 是发送方自己的身份，按它在
+// 本地 peer 表里反查是哪个已配置的 peer 发来的，并把观察到的 UDP 源地址记为
+// 它的（可能是刚打洞穿透 NAT 后的）端点。如果对方带了发送时间戳，原样回一条
+// frameHelloAck，供对方量 RTT。
+func handleHello(conn *net.UDPConn, rt *RoutingTable, from *net.UDPAddr, payload []byte) {
+	var hp helloPayload
+	if err := json.Unmarshal(payload, &hp); err != nil {
+		klog.V(4).Infof("bad hello from %s: %v", from, err)
+		return
+	}
+	p := rt.byName(hp.Name)
+	if p == nil {
+		klog.V(4).Infof("hello from unknown peer %q (%s)", hp.Name, from)
+		return
+	}
+	p.updateEndpoint(from)
+
+	if hp.SentUnixNano == 0 {
+		return
+	}
+	ack, err := json.Marshal(helloAckPayload{Version: helloVersion, SentUnixNano: hp.SentUnixNano})
+	if err != nil {
+		return
+	}
+	frame := append([]byte{frameHelloAck}, ack...)
+	if _, err := conn.WriteToUDP(frame, from); err != nil {
+		klog.V(4).Infof("send hello-ack to %s: %v", p.Name, err)
+	}
+}
+
+// handleHelloAck 处理一条 hello-ack：按来源端点找到对应的 peer，用带回来的
+// 发送时间戳算出这一次 hello/hello-ack 往返的 RTT。
+func handleHelloAck(rt *RoutingTable, from *net.UDPAddr, payload []byte) {
+	var ack helloAckPayload
+	if err := json.Unmarshal(payload, &ack); err != nil {
+		klog.V(4).Infof("bad hello-ack from %s: %v", from, err)
+		return
+	}
+	p := rt.byEndpoint(from)
+	if p == nil {
+		klog.V(4).Infof("hello-ack from unrecognized %s", from)
+		return
+	}
+	rtt := time.Duration(time.Now().UnixNano() - ack.SentUnixNano)
+	if rtt < 0 {
+		return
+	}
+	p.updateRTT(rtt)
+}
+
+// handleHandshakeInit 处理收到的 Noise-IK 握手第一条消息：解密对方的静态公钥，
+// 核对它是不是已配置的 peer，派生会话密钥并回一条 handshake-resp。
+func handleHandshakeInit(conn *net.UDPConn, rt *RoutingTable, local StaticKeypair, from *net.UDPAddr, payload []byte) {
+	m, err := unmarshalHandshakeInit(payload)
+	if err != nil {
+		klog.V(4).Infof("bad handshake-init from %s: %v", from, err)
+		return
+	}
+	resp, peerStatic, sendKey, recvKey, err := respondHandshake(local, m, maxHandshakeClockSkew)
+	if err != nil {
+		klog.V(4).Infof("handshake-init from %s rejected: %v", from, err)
+		metricHandshakeFailure("unknown")
+		return
+	}
+	p := rt.byStaticPub(peerStatic)
+	if p == nil {
+		klog.V(4).Infof("handshake-init from %s claims unknown static key", from)
+		metricHandshakeFailure("unknown")
+		return
+	}
+	if err := p.session.establish(sendKey, recvKey); err != nil {
+		klog.Warningf("establish session with %s: %v", p.Name, err)
+		metricHandshakeFailure(p.Name)
+		return
+	}
+	p.updateEndpoint(from)
+	p.markHandshakeEstablished()
+	klog.Infof("handshake with %s established (responder side)", p.Name)
+
+	frame := append([]byte{frameHSResp}, resp.marshal()...)
+	if _, err := conn.WriteToUDP(frame, from); err != nil {
+		klog.Warningf("send handshake-resp to %s: %v", p.Name, err)
+	}
+}
+
+// handleHandshakeResp 处理收到的 Noise-IK 握手第二条消息，完成发起方这一侧的
+// 密钥推导。按来源地址匹配到是哪个 peer 在等待这条回应。
+func handleHandshakeResp(rt *RoutingTable, local StaticKeypair, from *net.UDPAddr, payload []byte) {
+	p := rt.byEndpoint(from)
+	if p == nil {
+		klog.V(4).Infof("handshake-resp from unrecognized %s", from)
+		return
+	}
+	if !p.session.awaitingHandshakeResp() {
+		klog.V(4).Infof("unexpected handshake-resp from %s (state=%s)", p.Name, p.session.getState())
+		return
+	}
+	m, err := unmarshalHandshakeResp(payload)
+	if err != nil {
+		klog.V(4).Infof("bad handshake-resp from %s: %v", p.Name, err)
+		metricHandshakeFailure(p.Name)
+		return
+	}
+	p.session.mu.Lock()
+	pending := p.session.pending
+	p.session.mu.Unlock()
+	if pending == nil {
+		return
+	}
+	sendKey, recvKey, err := finishHandshake(local, pending, m)
+	if err != nil {
+		klog.Warningf("finish handshake with %s: %v", p.Name, err)
+		metricHandshakeFailure(p.Name)
+		return
+	}
+	if err := p.session.establish(sendKey, recvKey); err != nil {
+		klog.Warningf("establish session with %s: %v", p.Name, err)
+		metricHandshakeFailure(p.Name)
+		return
+	}
+	p.markHandshakeEstablished()
+	klog.Infof("handshake with %s established (initiator side)", p.Name)
+}
+
+// handshakeLoop 周期性检查每个 peer 的会话是否需要（重新）握手：从未建立过、
+// 到了 rekey 的消息数/时间阈值，或者上一次握手超时没有回应。
+func handshakeLoop(conn *net.UDPConn, rt *RoutingTable, local StaticKeypair, stop <-chan os.Signal) {
+	ticker := time.NewTicker(handshakeRetryTick)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			for _, p := range rt.all() {
+				ep := p.getEndpoint()
+				if ep == nil || !p.session.needsHandshake() {
+					continue
+				}
+				init, pending, err := initiateHandshake(local, p.staticPub)
+				if err != nil {
+					klog.Warningf("build handshake-init for %s: %v", p.Name, err)
+					continue
+				}
+				p.session.markHandshakeSent(pending)
+				metricHandshakeAttempt(p.Name)
+				frame := append([]byte{frameHSInit}, init.marshal()...)
+				if _, err := conn.WriteToUDP(frame, ep); err != nil {
+					klog.Warningf("send handshake-init to %s: %v", p.Name, err)
+					continue
+				}
+				klog.Infof("handshake-init sent to %s", p.Name)
 			}
 		}
-	}()
-
-	// 从 UDP -> TUN
-	go func() {
-		buf := make([]byte, 1<<16)
-		out := make([]byte, 1<<16)
-		for {
-			n, from, err := conn.ReadFromUDP(buf)
-			if err != nil {
-				log.Println("udp read:", err)
-				return
-			}
-			// 如果没指定 peer，则首次来包的人即为 peer（简易自发现）
-			if raddr == nil {
-				raddr = from
-				klog.Info("Peer learned:", raddr.String())
-			}
-			plain, ok := b.open(out[:0], buf[:n])
-			if !ok {
-				continue
-			}
-			if _, err := ifce.Write(plain); err != nil {
-				log.Println("tun write:", err)
+	}
+}
+
+// keepaliveLoop 周期性地给每个已知端点的 peer 发 hello 帧，用来保活并刷新 NAT 映射。
+// selfID 是本节点自己的身份（见 main 里的说明），会被对端用来反查是谁发来的包。
+func keepaliveLoop(conn *net.UDPConn, rt *RoutingTable, selfID string, stop <-chan os.Signal) {
+	ticker := time.NewTicker(keepaliveInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			for _, p := range rt.all() {
+				ep := p.getEndpoint()
+				if ep == nil {
+					continue
+				}
+				hp := helloPayload{Version: helloVersion, Name: selfID, SentUnixNano: time.Now().UnixNano()}
+				payload, err := json.Marshal(hp)
+				if err != nil {
+					continue
+				}
+				frame := append([]byte{frameHello}, payload...)
+				if _, err := conn.WriteToUDP(frame, ep); err != nil {
+					klog.V(4).Infof("keepalive to %s failed: %v", p.Name, err)
+				}
 			}
 		}
-	}()
+	}
+}
 
-	<-stop
-	klog.Info("Bye.")
+// reresolveLoop 周期性地对配置了域名端点的 peer 重新做 DNS 解析并更新端点，
+// 只处理还没有端点、或者超过 peerStaleAfter 没有收到过包的 peer；端点仍然
+// 活跃的 peer 不会被重新解析。
+func reresolveLoop(rt *RoutingTable, stop <-chan os.Signal) {
+	ticker := time.NewTicker(reresolveInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			for _, p := range rt.all() {
+				if p.endpointHost == "" {
+					continue
+				}
+				if !p.stale() && p.getEndpoint() != nil {
+					continue
+				}
+				addr, err := net.ResolveUDPAddr("udp", p.endpointHost)
+				if err != nil {
+					klog.V(4).Infof("re-resolve %s (%s) failed: %v", p.Name, p.endpointHost, err)
+					continue
+				}
+				p.updateEndpoint(addr)
+			}
+		}
+	}
 }
@@ -0,0 +1,293 @@
+// cmd/mini-overlay/noise.go
+//
+// 一个参照 WireGuard Noise_IK 思路实现的简化握手：双方各自持有长期 Curve25519
+// 静态密钥对，握手中交换一次性的 ephemeral 密钥，四次 DH（ee/se/es/ss 的变体）
+// 混合出链式密钥，最终派生出一对独立的收发会话密钥。和真正的 Noise 协议框架比，
+// 这里的 KDF 用单次 BLAKE2s 哈希代替了完整的 HKDF-Extract/Expand，少做了几处
+// 抗降级的域分隔；足够在这个学习项目里演示前向保密和握手状态机，不是生产实现。
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/binary"
+	"fmt"
+	"time"
+
+	"golang.org/x/crypto/blake2s"
+	"golang.org/x/crypto/chacha20poly1305"
+	"golang.org/x/crypto/curve25519"
+)
+
+// HandshakeState 描述一个 peer 的握手生命周期。
+type HandshakeState int
+
+const (
+	StateUninitialized HandshakeState = iota
+	StateHandshakeSent
+	StateEstablished
+	StateRekeying
+)
+
+func (s HandshakeState) String() string {
+	switch s {
+	case StateUninitialized:
+		return "Uninitialized"
+	case StateHandshakeSent:
+		return "HandshakeSent"
+	case StateEstablished:
+		return "Established"
+	case StateRekeying:
+		return "Rekeying"
+	default:
+		return "Unknown"
+	}
+}
+
+const noiseProtocolName = "mini-overlay Noise_IK v1"
+
+// handshakeInit 是 initiator -> responder 的第一条消息：
+// ephemeral 公钥明文 + 加密后的 initiator 静态公钥 + 加密后的时间戳。
+type handshakeInit struct {
+	Ephemeral    [32]byte
+	EncStatic    [32 + 16]byte
+	EncTimestamp [8 + 16]byte
+}
+
+func (m *handshakeInit) marshal() []byte {
+	buf := make([]byte, 0, 32+len(m.EncStatic)+len(m.EncTimestamp))
+	buf = append(buf, m.Ephemeral[:]...)
+	buf = append(buf, m.EncStatic[:]...)
+	buf = append(buf, m.EncTimestamp[:]...)
+	return buf
+}
+
+func unmarshalHandshakeInit(b []byte) (*handshakeInit, error) {
+	const want = 32 + 32 + 16 + 8 + 16
+	if len(b) != want {
+		return nil, fmt.Errorf("bad handshake-init length %d (want %d)", len(b), want)
+	}
+	m := &handshakeInit{}
+	copy(m.Ephemeral[:], b[0:32])
+	copy(m.EncStatic[:], b[32:32+48])
+	copy(m.EncTimestamp[:], b[80:80+24])
+	return m, nil
+}
+
+// handshakeResp 是 responder -> initiator 的第二条消息: ephemeral 公钥明文 +
+// 一段空的加密确认（只用来让两边确认各自推导出的密钥一致）。
+type handshakeResp struct {
+	Ephemeral [32]byte
+	EncEmpty  [16]byte
+}
+
+func (m *handshakeResp) marshal() []byte {
+	buf := make([]byte, 0, 32+16)
+	buf = append(buf, m.Ephemeral[:]...)
+	buf = append(buf, m.EncEmpty[:]...)
+	return buf
+}
+
+func unmarshalHandshakeResp(b []byte) (*handshakeResp, error) {
+	if len(b) != 32+16 {
+		return nil, fmt.Errorf("bad handshake-resp length %d", len(b))
+	}
+	m := &handshakeResp{}
+	copy(m.Ephemeral[:], b[0:32])
+	copy(m.EncEmpty[:], b[32:48])
+	return m, nil
+}
+
+// kdf 把链式密钥 ck 和一段输入混合出下一个链式密钥，类比 Noise 的 MixKey。
+func kdf(ck [32]byte, input []byte) [32]byte {
+	h, _ := blake2s.New256(nil)
+	h.Write(ck[:])
+	h.Write(input)
+	var out [32]byte
+	copy(out[:], h.Sum(nil))
+	return out
+}
+
+// kdf2 从最终链式密钥派生出两把方向独立的会话密钥。
+func kdf2(ck [32]byte) (k1, k2 [32]byte) {
+	h1, _ := blake2s.New256(nil)
+	h1.Write(ck[:])
+	h1.Write([]byte{0x01})
+	copy(k1[:], h1.Sum(nil))
+
+	h2, _ := blake2s.New256(nil)
+	h2.Write(ck[:])
+	h2.Write([]byte{0x02})
+	copy(k2[:], h2.Sum(nil))
+	return
+}
+
+func dh(priv, pub [32]byte) ([32]byte, error) {
+	var out [32]byte
+	shared, err := curve25519.X25519(priv[:], pub[:])
+	if err != nil {
+		return out, err
+	}
+	copy(out[:], shared)
+	return out, nil
+}
+
+// encryptWithCK 用当前链式密钥直接当 AEAD 密钥、nonce 固定为 0 加密一段短
+// payload。在 Noise 的 symmetric state 里这是安全的，因为 ck 每用一次就会
+// 随着下一次 MixKey 演化，同一把密钥不会被用来加密两段不同的数据。
+func encryptWithCK(ck [32]byte, plaintext []byte) ([]byte, error) {
+	aead, err := chacha20poly1305.New(ck[:])
+	if err != nil {
+		return nil, err
+	}
+	var nonce [chacha20poly1305.NonceSize]byte
+	return aead.Seal(nil, nonce[:], plaintext, nil), nil
+}
+
+func decryptWithCK(ck [32]byte, ciphertext []byte) ([]byte, error) {
+	aead, err := chacha20poly1305.New(ck[:])
+	if err != nil {
+		return nil, err
+	}
+	var nonce [chacha20poly1305.NonceSize]byte
+	return aead.Open(nil, nonce[:], ciphertext, nil)
+}
+
+// initiateHandshake 构造一条 handshake-init 消息，发给持有 responderStatic
+// 公钥的对端。返回消息本体和握手过程中用到的临时状态（ephemeral 私钥、ck），
+// 这些状态要留到收到 handshake-resp 时才能完成密钥推导。
+type pendingHandshake struct {
+	ephemeral StaticKeypair
+	ck        [32]byte
+	startedAt time.Time
+}
+
+func initiateHandshake(local StaticKeypair, responderStatic [32]byte) (*handshakeInit, *pendingHandshake, error) {
+	eph, err := generateStaticKeypair()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	ck := kdf([32]byte(blake2s.Sum256([]byte(noiseProtocolName))), responderStatic[:])
+
+	dh1, err := dh(eph.priv, responderStatic)
+	if err != nil {
+		return nil, nil, err
+	}
+	ck = kdf(ck, dh1[:])
+	encStatic, err := encryptWithCK(ck, local.pub[:])
+	if err != nil {
+		return nil, nil, err
+	}
+
+	dh2, err := dh(local.priv, responderStatic)
+	if err != nil {
+		return nil, nil, err
+	}
+	ck = kdf(ck, dh2[:])
+	var ts [8]byte
+	binary.BigEndian.PutUint64(ts[:], uint64(time.Now().Unix()))
+	encTimestamp, err := encryptWithCK(ck, ts[:])
+	if err != nil {
+		return nil, nil, err
+	}
+
+	m := &handshakeInit{Ephemeral: eph.pub}
+	copy(m.EncStatic[:], encStatic)
+	copy(m.EncTimestamp[:], encTimestamp)
+
+	return m, &pendingHandshake{ephemeral: eph, ck: ck, startedAt: time.Now()}, nil
+}
+
+// respondHandshake 处理收到的 handshake-init：解出对方的静态公钥（用来核实
+// 是否是已知 peer）、校验时间戳没有过期太久（防止重放旧的握手包），然后生成
+// 自己的 ephemeral 并派生出最终的收发密钥。
+func respondHandshake(local StaticKeypair, m *handshakeInit, maxClockSkew time.Duration) (resp *handshakeResp, peerStatic [32]byte, sendKey, recvKey [32]byte, err error) {
+	ck := kdf([32]byte(blake2s.Sum256([]byte(noiseProtocolName))), local.pub[:])
+
+	dh1, err := dh(local.priv, m.Ephemeral)
+	if err != nil {
+		return nil, peerStatic, sendKey, recvKey, err
+	}
+	ck = kdf(ck, dh1[:])
+	staticRaw, err := decryptWithCK(ck, m.EncStatic[:])
+	if err != nil {
+		return nil, peerStatic, sendKey, recvKey, fmt.Errorf("decrypt initiator static key: %w", err)
+	}
+	copy(peerStatic[:], staticRaw)
+
+	dh2, err := dh(local.priv, peerStatic)
+	if err != nil {
+		return nil, peerStatic, sendKey, recvKey, err
+	}
+	ck = kdf(ck, dh2[:])
+	tsRaw, err := decryptWithCK(ck, m.EncTimestamp[:])
+	if err != nil {
+		return nil, peerStatic, sendKey, recvKey, fmt.Errorf("decrypt timestamp: %w", err)
+	}
+	ts := time.Unix(int64(binary.BigEndian.Uint64(tsRaw)), 0)
+	if skew := time.Since(ts); skew > maxClockSkew || skew < -maxClockSkew {
+		return nil, peerStatic, sendKey, recvKey, fmt.Errorf("handshake timestamp too far off (%v)", skew)
+	}
+
+	eph, err := generateStaticKeypair()
+	if err != nil {
+		return nil, peerStatic, sendKey, recvKey, err
+	}
+
+	dh3, err := dh(eph.priv, m.Ephemeral)
+	if err != nil {
+		return nil, peerStatic, sendKey, recvKey, err
+	}
+	ck = kdf(ck, dh3[:])
+
+	dh4, err := dh(eph.priv, peerStatic)
+	if err != nil {
+		return nil, peerStatic, sendKey, recvKey, err
+	}
+	ck = kdf(ck, dh4[:])
+
+	k1, k2 := kdf2(ck)
+	// responder 的发送方向对应 initiator 的接收方向，所以这里用 k1 当 send、k2 当 recv；
+	// initiator 那边要反过来取，见 finishHandshake。
+	sendKey, recvKey = k1, k2
+
+	encEmpty, err := encryptWithCK(ck, nil)
+	if err != nil {
+		return nil, peerStatic, sendKey, recvKey, err
+	}
+	r := &handshakeResp{Ephemeral: eph.pub}
+	copy(r.EncEmpty[:], encEmpty)
+
+	return r, peerStatic, sendKey, recvKey, nil
+}
+
+// finishHandshake 是 initiator 收到 handshake-resp 后的收尾：重放对称的 DH
+// 链路，推导出和 responder 一致的一对密钥（方向相反）。
+func finishHandshake(local StaticKeypair, pending *pendingHandshake, m *handshakeResp) (sendKey, recvKey [32]byte, err error) {
+	ck := pending.ck
+
+	dh3, err := dh(pending.ephemeral.priv, m.Ephemeral)
+	if err != nil {
+		return sendKey, recvKey, err
+	}
+	ck = kdf(ck, dh3[:])
+
+	dh4, err := dh(local.priv, m.Ephemeral)
+	if err != nil {
+		return sendKey, recvKey, err
+	}
+	ck = kdf(ck, dh4[:])
+
+	if _, err := decryptWithCK(ck, m.EncEmpty[:]); err != nil {
+		return sendKey, recvKey, fmt.Errorf("handshake confirmation failed: %w", err)
+	}
+
+	k1, k2 := kdf2(ck)
+	// initiator 的 send 对应 responder 的 recv（k2），反之亦然。
+	sendKey, recvKey = k2, k1
+	return sendKey, recvKey, nil
+}
+
+func constantTimeEqual32(a, b [32]byte) bool {
+	return subtle.ConstantTimeCompare(a[:], b[:]) == 1
+}
@@ -0,0 +1,269 @@
+// cmd/mini-overlay/session.go
+package main
+
+import (
+	"crypto/cipher"
+	"encoding/binary"
+	"fmt"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/chacha20poly1305"
+)
+
+const (
+	// rekey 触发条件：消息数或时间，先到者触发，和 WireGuard 的 REKEY-AFTER-* 常量同一量级。
+	rekeyAfterMessages = 1 << 20
+	rekeyAfterTime     = 2 * time.Minute
+
+	// 回放窗口大小（位图宽度），足够应对乱序到达。
+	replayWindowSize  = 2048
+	replayWindowWords = replayWindowSize / 64
+
+	maxHandshakeClockSkew = 2 * time.Minute
+)
+
+// replayWindow 是一个滑动位图，拒绝重复或过旧的 counter。位图由
+// replayWindowWords 个 uint64 字组成，共 replayWindowSize 位，字 i 的位 j
+// 对应 counter = last - (i*64 + j)。
+type replayWindow struct {
+	mu     sync.Mutex
+	last   uint64
+	window [replayWindowWords]uint64
+	inited bool
+}
+
+// validate 只检查 counter 是否新鲜（没见过、没有太旧），不修改窗口状态。
+// 必须在 AEAD 认证通过之前调用，用来尽早拒绝明显无效的包；不能代替 commit——
+// 不然一个携带伪造 counter 的未认证包就能把窗口推到任意位置，把之后所有
+// 合法包都判成"太旧"（参见 commit 的注释）。
+func (r *replayWindow) validate(counter uint64) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if !r.inited || counter > r.last {
+		return true
+	}
+	diff := r.last - counter
+	if diff >= replayWindowSize {
+		return false // 太旧，位图覆盖不到
+	}
+	return !r.testBit(diff) // testBit 为真就是重放
+}
+
+// commit 把 counter 记为已经见过，推进窗口。只应该在对应的包已经通过了
+// AEAD 认证之后才调用——窗口的推进必须以"确认是对端发的"为前提，否则
+// 一个源地址伪造的包就能在认证失败前抢先把 last 拽到很远，造成对后续
+// 合法包的拒绝服务（窗口覆盖不到它们了）。
+func (r *replayWindow) commit(counter uint64) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if !r.inited {
+		r.inited = true
+		r.last = counter
+		r.window[0] = 1
+		return
+	}
+
+	if counter > r.last {
+		shift := counter - r.last
+		r.shiftWindow(shift)
+		r.last = counter
+		r.setBit(0)
+		return
+	}
+
+	diff := r.last - counter
+	if diff >= replayWindowSize {
+		return // 太旧，位图覆盖不到，忽略
+	}
+	r.setBit(diff)
+}
+
+// shiftWindow 把位图整体左移 shift 位（last 前进 shift），丢弃移出窗口的旧位。
+func (r *replayWindow) shiftWindow(shift uint64) {
+	if shift >= replayWindowSize {
+		r.window = [replayWindowWords]uint64{}
+		return
+	}
+	wordShift := int(shift / 64)
+	bitShift := uint(shift % 64)
+	var shifted [replayWindowWords]uint64
+	for i := replayWindowWords - 1; i >= 0; i-- {
+		src := i - wordShift
+		if src < 0 {
+			continue
+		}
+		shifted[i] = r.window[src] << bitShift
+		if bitShift != 0 && src-1 >= 0 {
+			shifted[i] |= r.window[src-1] >> (64 - bitShift)
+		}
+	}
+	r.window = shifted
+}
+
+func (r *replayWindow) testBit(diff uint64) bool {
+	word, bit := diff/64, diff%64
+	return r.window[word]&(uint64(1)<<bit) != 0
+}
+
+func (r *replayWindow) setBit(diff uint64) {
+	word, bit := diff/64, diff%64
+	r.window[word] |= uint64(1) << bit
+}
+
+// Session 保存一个 peer 当前这一代握手产生的收发密钥、计数器 nonce 和状态机。
+type Session struct {
+	mu sync.Mutex
+
+	state HandshakeState
+
+	sendKey  [32]byte
+	recvKey  [32]byte
+	sendAEAD cipher.AEAD
+	recvAEAD cipher.AEAD
+
+	sendCounter uint64
+	recvReplay  replayWindow
+
+	pending        *pendingHandshake // 有一次握手在途时非空（StateHandshakeSent 或 StateRekeying）
+	establishedAt  time.Time
+	msgsSinceRekey uint64
+}
+
+func (s *Session) getState() HandshakeState {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.state
+}
+
+// awaitingHandshakeResp 判断当前是否正在等待一条 handshake-resp：首次握手
+// 落在 StateHandshakeSent，rekey 场景则留在 StateRekeying（见
+// markHandshakeSent），两种情况都还需要用 pending 非空确认确实有一次在途
+// 的握手，而不是状态机碰巧停在那儿。
+func (s *Session) awaitingHandshakeResp() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.pending != nil && (s.state == StateHandshakeSent || s.state == StateRekeying)
+}
+
+// needsHandshake 判断是否应该（重新）发起握手：从未建立过，或者触达了
+// rekey 的消息数/时间阈值。
+func (s *Session) needsHandshake() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	switch s.state {
+	case StateUninitialized:
+		return true
+	case StateEstablished:
+		if s.msgsSinceRekey >= rekeyAfterMessages || time.Since(s.establishedAt) >= rekeyAfterTime {
+			// 旧的收发密钥在新握手完成前继续有效，这里只是把状态机推进到
+			// Rekeying，标记"已经决定要重新握手"，seal/open 仍然放行。
+			s.state = StateRekeying
+			return true
+		}
+	case StateRekeying, StateHandshakeSent:
+		// 握手发出去太久没回应，当作失败重来。
+		if s.pending != nil && time.Since(s.pending.startedAt) > 5*time.Second {
+			return true
+		}
+	}
+	return false
+}
+
+// markHandshakeSent 记下已经发出去、正在等待 handshake-resp 的那次握手。
+// 如果这是一次 rekey（当前在 StateRekeying），状态机留在 StateRekeying 而不
+// 推进到 StateHandshakeSent——旧的收发密钥还在，seal/open 得继续放行，不然
+// 握手这一轮来回的几百毫秒里这个 peer 的数据全部会被当成"session not
+// established"丢掉。只有从零开始的首次握手（没有旧密钥可用）才会落到
+// StateHandshakeSent，这时候数据确实还没法收发，阻塞是对的。
+func (s *Session) markHandshakeSent(p *pendingHandshake) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.state != StateRekeying {
+		s.state = StateHandshakeSent
+	}
+	s.pending = p
+}
+
+func (s *Session) establish(sendKey, recvKey [32]byte) error {
+	sendAEAD, err := chacha20poly1305.New(sendKey[:])
+	if err != nil {
+		return err
+	}
+	recvAEAD, err := chacha20poly1305.New(recvKey[:])
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.sendKey, s.recvKey = sendKey, recvKey
+	s.sendAEAD, s.recvAEAD = sendAEAD, recvAEAD
+	s.sendCounter = 0
+	s.recvReplay = replayWindow{}
+	s.msgsSinceRekey = 0
+	s.establishedAt = time.Now()
+	s.state = StateEstablished
+	s.pending = nil
+	return nil
+}
+
+func counterNonce(counter uint64) [chacha20poly1305.NonceSize]byte {
+	var nonce [chacha20poly1305.NonceSize]byte
+	binary.LittleEndian.PutUint64(nonce[4:], counter) // 前 4 字节保留为 0，和 WireGuard 的 nonce 布局一致
+	return nonce
+}
+
+// seal 加密一个内层包，返回 "8 字节计数器 || 密文" 的载荷。dst 是调用方提供
+// 的复用缓冲区（传 nil 等价于每次都新分配一块），批量
+// 收发路径靠它把每个包的 Seal 输出摊到一圈预分配的 buffer 上，省掉逐包分配。
+func (s *Session) seal(dst, plaintext []byte) (payload []byte, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	// Rekeying 只是"已决定要重新握手"，旧的收发密钥在新握手完成前仍然有效。
+	if s.state != StateEstablished && s.state != StateRekeying {
+		return nil, fmt.Errorf("session not established (state=%s)", s.state)
+	}
+	counter := s.sendCounter
+	s.sendCounter++
+	s.msgsSinceRekey++
+
+	nonce := counterNonce(counter)
+	var counterBuf [8]byte
+	binary.BigEndian.PutUint64(counterBuf[:], counter)
+
+	out := append(dst[:0], counterBuf[:]...)
+	out = s.sendAEAD.Seal(out, nonce[:], plaintext, nil)
+	return out, nil
+}
+
+// open 解密一个 "8 字节计数器 || 密文" 的载荷，校验回放窗口。dst 规则同 seal。
+//
+// 顺序很重要：先用 validate 挡掉明显太旧/重放的 counter，再做 AEAD 认证，
+// 只有认证通过之后才 commit 进窗口——这样一个来源地址伪造、counter 乱写的
+// 未认证包最多让自己被拒绝，不会提前推进窗口、连累后面的合法包被误判成
+// "太旧"（WireGuard 的 ReceiveWindow 是同样的先验证、认证后才提交的顺序）。
+func (s *Session) open(dst, payload []byte) ([]byte, error) {
+	if len(payload) < 8 {
+		return nil, fmt.Errorf("session payload too short")
+	}
+	counter := binary.BigEndian.Uint64(payload[:8])
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	// Rekeying 只是"已决定要重新握手"，旧的收发密钥在新握手完成前仍然有效。
+	if s.state != StateEstablished && s.state != StateRekeying {
+		return nil, fmt.Errorf("session not established (state=%s)", s.state)
+	}
+	if !s.recvReplay.validate(counter) {
+		return nil, fmt.Errorf("replayed or stale counter %d", counter)
+	}
+	nonce := counterNonce(counter)
+	plaintext, err := s.recvAEAD.Open(dst[:0], nonce[:], payload[8:], nil)
+	if err != nil {
+		return nil, err
+	}
+	s.recvReplay.commit(counter)
+	return plaintext, nil
+}
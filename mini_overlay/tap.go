@@ -0,0 +1,232 @@
+// cmd/mini-overlay/tap.go
+//
+// TAP (L2) 模式：在 TUN 的三层路由之外，再提供一种"学习交换机"模式——
+// 维护一张 MAC -> peer 的表，通过观察入方向帧的源 MAC 来学习，出方向按目的
+// MAC 转发；广播/多播/未知单播就 flood 给所有已知 peer（per-peer 限速）。
+// 这样一个 L2 网段就可以跨越多个节点，顺带还能跑非 IP 协议和 DHCP。
+package main
+
+import (
+	"log"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/songgao/water"
+	"golang.org/x/time/rate"
+	"k8s.io/klog/v2"
+)
+
+type macKey [6]byte
+
+func (m macKey) String() string {
+	return net.HardwareAddr(m[:]).String()
+}
+
+// isBroadcast 判断是不是全 1 的以太网广播地址。
+func (m macKey) isBroadcast() bool {
+	for _, b := range m {
+		if b != 0xff {
+			return false
+		}
+	}
+	return true
+}
+
+// isMulticast 用 I/G 位判断多播（广播地址也会命中，调用方通常先判断 isBroadcast）。
+func (m macKey) isMulticast() bool {
+	return m[0]&0x01 != 0
+}
+
+func extractDstMAC(frame []byte) (macKey, bool) {
+	var m macKey
+	if len(frame) < 12 {
+		return m, false
+	}
+	copy(m[:], frame[0:6])
+	return m, true
+}
+
+func extractSrcMAC(frame []byte) (macKey, bool) {
+	var m macKey
+	if len(frame) < 12 {
+		return m, false
+	}
+	copy(m[:], frame[6:12])
+	return m, true
+}
+
+type macEntry struct {
+	peer *Peer
+	seen time.Time
+}
+
+// MACTable 是学习交换机的转发表：记录每个 MAC 最近一次是从哪个 peer 学到的。
+type MACTable struct {
+	mu sync.RWMutex
+	m  map[macKey]*macEntry
+}
+
+func newMACTable() *MACTable {
+	return &MACTable{m: make(map[macKey]*macEntry)}
+}
+
+func (t *MACTable) learn(mac macKey, p *Peer) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if e, ok := t.m[mac]; !ok {
+		klog.Infof("mac %s learned via peer %s", mac, p.Name)
+	} else if e.peer != p {
+		klog.Infof("mac %s moved from peer %s to peer %s", mac, e.peer.Name, p.Name)
+	}
+	t.m[mac] = &macEntry{peer: p, seen: time.Now()}
+}
+
+func (t *MACTable) lookup(mac macKey) *Peer {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	if e, ok := t.m[mac]; ok {
+		return e.peer
+	}
+	return nil
+}
+
+// floodLimiters 给每个 peer 一个独立的令牌桶，限制广播/多播/未知单播的 flood
+// 流量，避免一个网段里的风暴把所有链路都打满。
+type floodLimiters struct {
+	mu  sync.Mutex
+	rps float64
+	m   map[string]*rate.Limiter
+}
+
+func newFloodLimiters(rps float64) *floodLimiters {
+	return &floodLimiters{rps: rps, m: make(map[string]*rate.Limiter)}
+}
+
+func (f *floodLimiters) allow(peerName string) bool {
+	f.mu.Lock()
+	l, ok := f.m[peerName]
+	if !ok {
+		burst := int(f.rps)
+		if burst < 1 {
+			burst = 1
+		}
+		l = rate.NewLimiter(rate.Limit(f.rps), burst)
+		f.m[peerName] = l
+	}
+	f.mu.Unlock()
+	return l.Allow()
+}
+
+// tapToUDP 是 TAP -> UDP 方向：已知目的 MAC 就单播给学到的那个 peer，否则
+// （广播/多播/未知单播）flood 给所有当前有端点的 peer，每个 peer 独立限速。
+func tapToUDP(ifce *water.Interface, conn *net.UDPConn, rt *RoutingTable, mode string, b *box, macTable *MACTable, flood *floodLimiters) {
+	buf := make([]byte, 1<<16)
+	frame := make([]byte, 0, 1<<16)
+	for {
+		n, err := ifce.Read(buf)
+		if err != nil {
+			log.Println("tap read:", err)
+			return
+		}
+		eth := buf[:n]
+		dst, ok := extractDstMAC(eth)
+		if !ok {
+			continue
+		}
+
+		var targets []*Peer
+		if !dst.isBroadcast() && !dst.isMulticast() {
+			if p := macTable.lookup(dst); p != nil {
+				targets = []*Peer{p}
+			}
+		}
+		if targets == nil {
+			for _, p := range rt.all() {
+				if p.getEndpoint() == nil {
+					continue
+				}
+				if !flood.allow(p.Name) {
+					klog.V(4).Infof("flood to %s rate-limited, dropping", p.Name)
+					continue
+				}
+				targets = append(targets, p)
+			}
+		}
+
+		for _, p := range targets {
+			ep := p.getEndpoint()
+			if ep == nil {
+				continue
+			}
+			sealed, err := sealForPeer(mode, b, p, nil, eth)
+			if err != nil {
+				if err != errSessionNotEstablished {
+					log.Println("seal:", err)
+					metricSealError(p.Name)
+				}
+				continue
+			}
+			frame = append(frame[:0], frameData)
+			frame = append(frame, sealed...)
+			metricTunnelTx(p.Name, len(eth))
+			if _, err := conn.WriteToUDP(frame, ep); err != nil {
+				log.Println("udp write:", err)
+			}
+		}
+	}
+}
+
+// udpToTAP 是 UDP -> TAP 方向：解密出以太网帧后，用源 MAC 学习它属于哪个
+// peer，再把帧原样写回本地 TAP（mesh 里每个节点都直连其它 peer，不需要
+// 再次转发/flood，避免广播风暴）。
+func udpToTAP(ifce *water.Interface, conn *net.UDPConn, rt *RoutingTable, mode string, b *box, localKey StaticKeypair, macTable *MACTable) {
+	buf := make([]byte, 1<<16)
+	for {
+		n, from, err := conn.ReadFromUDP(buf)
+		if err != nil {
+			log.Println("udp read:", err)
+			return
+		}
+		if n < 1 {
+			continue
+		}
+		typ := buf[0]
+		payload := buf[1:n]
+		switch typ {
+		case frameHello:
+			handleHello(conn, rt, from, payload)
+		case frameHelloAck:
+			handleHelloAck(rt, from, payload)
+		case frameHSInit:
+			handleHandshakeInit(conn, rt, localKey, from, payload)
+		case frameHSResp:
+			handleHandshakeResp(rt, localKey, from, payload)
+		case frameData:
+			plain, peer, err := openForPeer(mode, b, rt, from, nil, payload)
+			if err != nil {
+				if err != errSessionNotEstablished {
+					klog.V(4).Infof("open from %s failed: %v", from, err)
+					metricOpenError(peerNameOrUnknown(peer))
+				}
+				continue
+			}
+			if peer == nil {
+				// psk 模式下没有按 peer 区分的会话，按端点再找一次以确定学习来源。
+				peer = rt.byEndpoint(from)
+			}
+			if src, ok := extractSrcMAC(plain); ok && peer != nil {
+				macTable.learn(src, peer)
+			}
+			if peer != nil {
+				peer.updateEndpoint(from)
+			}
+			metricTunnelRx(peerNameOrUnknown(peer), len(plain))
+			if _, err := ifce.Write(plain); err != nil {
+				log.Println("tap write:", err)
+			}
+		default:
+			klog.V(4).Infof("unknown frame type 0x%02x from %s", typ, from)
+		}
+	}
+}
@@ -0,0 +1,113 @@
+// netinspect/netlink.go
+//
+// enrichWithNetlink 补上 sysfs 不好拿、或者干脆没有的字段：VLAN id、VXLAN
+// VNI/remote、bond 的 mode/slaves、bridge 的 STP 状态/成员口、WireGuard 的
+// peer 数/监听端口，以及 veth 对端的 ifindex。任何一步失败都只是拿不到那个
+// 字段，不应该让调用方连接口的基础信息都拿不到——所以这里只返回"整体是否
+// 至少拿到了 netlink link"这一层面的 error，细分字段缺失就留零值。
+package netinspect
+
+import (
+	"fmt"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/vishvananda/netlink"
+	"golang.zx2c4.com/wireguard/wgctrl"
+)
+
+func enrichWithNetlink(info *IfInfo) error {
+	link, err := netlink.LinkByName(info.Name)
+	if err != nil {
+		return fmt.Errorf("netlink LinkByName(%s): %w", info.Name, err)
+	}
+
+	switch l := link.(type) {
+	case *netlink.Vlan:
+		info.VLANID = l.VlanId
+	case *netlink.Vxlan:
+		info.VXLANVNI = l.VxlanId
+		if l.Group != nil && !l.Group.IsUnspecified() {
+			info.VXLANRemote = l.Group.String()
+		}
+	case *netlink.Bond:
+		info.BondMode = l.Mode.String()
+		info.BondSlaves = membersOf(l.Attrs().Index)
+	case *netlink.Bridge:
+		info.BridgeMembers = membersOf(l.Attrs().Index)
+		info.BridgeSTP = bridgeSTPState(info.Name)
+	case *netlink.Veth:
+		// 非 veth 接口的 sysfs iflink 也会等于自己的 ifindex（未设置时的默认
+		// 值），只有确认链路类型是 veth 才去读、避免把这个值当成"对端"误报。
+		if vp, ok := vethPeerIndex(info.Name); ok {
+			info.VethPeerIndex = vp
+		}
+	}
+
+	enrichWireGuard(info)
+
+	return nil
+}
+
+// membersOf 列出 MasterIndex 等于给定接口（bridge/bond）索引的所有从属接口名字。
+func membersOf(masterIndex int) []string {
+	links, err := netlink.LinkList()
+	if err != nil {
+		return nil
+	}
+	var members []string
+	for _, l := range links {
+		if l.Attrs().MasterIndex == masterIndex {
+			members = append(members, l.Attrs().Name)
+		}
+	}
+	return members
+}
+
+// bridgeSTPState 读 sysfs 的 bridge/stp_state：netlink 的 Bridge 类型本身不
+// 携带这个值，sysfs 数字反而是最直接可靠的来源（0=禁用 1=STP 2=RSTP）。
+func bridgeSTPState(name string) string {
+	raw := readFirst(filepath.Join(sysClassNet, name, "bridge", "stp_state"))
+	switch raw {
+	case "0":
+		return "disabled"
+	case "1":
+		return "stp"
+	case "2":
+		return "rstp"
+	default:
+		return ""
+	}
+}
+
+// vethPeerIndex 读 sysfs 的 iflink，拿到 veth 对端的 ifindex——这是解析
+// veth pair 对端最可靠的办法，比尝试用 netlink 猜测要稳。
+func vethPeerIndex(name string) (int, bool) {
+	raw := readFirst(filepath.Join(sysClassNet, name, "iflink"))
+	if raw == "" {
+		return 0, false
+	}
+	idx, err := strconv.Atoi(strings.TrimSpace(raw))
+	if err != nil {
+		return 0, false
+	}
+	return idx, true
+}
+
+// enrichWireGuard 尝试用 wgctrl 打开同名设备拿 peer 数和监听端口；不是
+// WireGuard 接口或者没权限都静默跳过，这俩字段保持零值。
+func enrichWireGuard(info *IfInfo) {
+	client, err := wgctrl.New()
+	if err != nil {
+		return
+	}
+	defer client.Close()
+
+	dev, err := client.Device(info.Name)
+	if err != nil {
+		return
+	}
+	info.WireGuardPeers = len(dev.Peers)
+	info.ListenPort = dev.ListenPort
+}
@@ -1,52 +1,77 @@
+// cmd/network-inspect/main.go
+//
+// network-inspect 是 netinspect 包的一个瘦命令行外壳：枚举本机接口（或者
+// 用 -iface 只看一个），按 -o 选的格式打印出来。真正的分类/netlink 补全逻辑
+// 都在 netinspect 包里，方便其它程序（比如 mini-overlay）直接 import。
 package main
 
 import (
+	"encoding/json"
+	"flag"
 	"fmt"
-	"net"
 	"os"
-	"path/filepath"
-	"strconv"
 	"strings"
+
+	"github.com/HaojieZhang6848/network_learning/netinspect"
+	"gopkg.in/yaml.v3"
 )
 
-const sysClassNet = "/sys/class/net"
+func main() {
+	var (
+		output = flag.String("o", "table", "output format: table|json|yaml")
+		iface  = flag.String("iface", "", "only inspect this interface (default: all)")
+	)
+	flag.Parse()
+
+	var list []netinspect.IfInfo
+	if *iface != "" {
+		info, err := netinspect.Inspect(*iface)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s: %v\n", *iface, err)
+			os.Exit(1)
+		}
+		list = []netinspect.IfInfo{info}
+	} else {
+		var err error
+		list, err = netinspect.List()
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "list interfaces:", err)
+			os.Exit(1)
+		}
+	}
 
-type IfInfo struct {
-	Name       string
-	Type       string
-	MTU        int
-	Flags      string
-	MAC        string
-	IPs        []string
-	OperState  string
-	Carrier    string
-	Speed      string
-	Duplex     string
-	Driver     string
-	SysfsPath  string
-	Master     string // 上级设备（如 bridge/bond）
-	IsVirtual  bool
+	switch strings.ToLower(*output) {
+	case "json":
+		printJSON(list)
+	case "yaml":
+		printYAML(list)
+	case "table", "":
+		printTable(list)
+	default:
+		fmt.Fprintf(os.Stderr, "unknown -o %q, want table|json|yaml\n", *output)
+		os.Exit(1)
+	}
 }
 
-func main() {
-	ifaces, err := os.ReadDir(sysClassNet)
-	if err != nil {
-		fmt.Println("read sysfs:", err)
-		return
+func printJSON(list []netinspect.IfInfo) {
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(list); err != nil {
+		fmt.Fprintln(os.Stderr, "encode json:", err)
+		os.Exit(1)
 	}
+}
 
-	var list []IfInfo
-	for _, de := range ifaces {
-		name := de.Name()
-		info, err := inspectIface(name)
-		if err != nil {
-			fmt.Printf("%s: %v\n", name, err)
-			continue
-		}
-		list = append(list, info)
+func printYAML(list []netinspect.IfInfo) {
+	b, err := yaml.Marshal(list)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "encode yaml:", err)
+		os.Exit(1)
 	}
+	os.Stdout.Write(b)
+}
 
-	// 输出
+func printTable(list []netinspect.IfInfo) {
 	for _, it := range list {
 		fmt.Printf("=== %s ===\n", it.Name)
 		fmt.Printf("Type:       %s\n", it.Type)
@@ -64,192 +89,33 @@ func main() {
 		if it.Master != "" {
 			fmt.Printf("Master:     %s\n", it.Master)
 		}
+		if it.Enriched {
+			printEnrichedTable(it)
+		}
 		fmt.Printf("Sysfs:      %s\n", it.SysfsPath)
 		fmt.Println()
 	}
 }
 
-func inspectIface(name string) (IfInfo, error) {
-	var out IfInfo
-	out.Name = name
-
-	syslink := filepath.Join(sysClassNet, name)
-	real, _ := filepath.EvalSymlinks(syslink)
-	out.SysfsPath = real
-
-	out.IsVirtual = strings.Contains(real, "/virtual/")
-
-	ifi, err := net.InterfaceByName(name)
-	if err == nil {
-		out.MTU = ifi.MTU
-		out.Flags = ifi.Flags.String()
-		out.MAC = ifi.HardwareAddr.String()
-		addrs, _ := ifi.Addrs()
-		for _, a := range addrs {
-			out.IPs = append(out.IPs, a.String())
-		}
-	}
-
-	out.OperState = readFirst(filepath.Join(syslink, "operstate"))
-	out.Carrier = readFirst(filepath.Join(syslink, "carrier"))
-	out.Speed = readFirst(filepath.Join(syslink, "speed"))   // Mb/s（部分虚拟口没有）
-	out.Duplex = readFirst(filepath.Join(syslink, "duplex")) // full/half（部分虚拟口没有）
-
-	out.Driver = detectDriver(syslink)
-	out.Master = detectMaster(syslink)
-
-	// 判别类型（按特征由强到弱）
-	out.Type = classify(name, syslink, real, out)
-
-	return out, nil
-}
-
-func classify(name, syslink, real string, info IfInfo) string {
-	// 1) 明确特征目录
-	if exists(filepath.Join(syslink, "bridge")) {
-		return "bridge"
-	}
-	if exists(filepath.Join(syslink, "bonding")) {
-		return "bond"
-	}
-	if exists(filepath.Join(syslink, "team")) {
-		return "team"
-	}
-	if exists(filepath.Join(syslink, "vxlan")) {
-		return "vxlan"
-	}
-	// vlan: /proc/net/vlan/<iface> 存在即为 VLAN 子接口
-	if exists(filepath.Join("/proc/net/vlan", name)) {
-		return "vlan"
-	}
-	// tun/tap: 有 tun_flags；用位判断
-	if exists(filepath.Join(syslink, "tun_flags")) {
-		flagsStr := readFirst(filepath.Join(syslink, "tun_flags"))
-		if v, err := strconv.ParseUint(strings.TrimSpace(flagsStr), 0, 32); err == nil {
-			const IFF_TUN = 0x0001
-			const IFF_TAP = 0x0002
-			if v&IFF_TAP != 0 {
-				return "tap (TAP virtual L2)"
-			}
-			if v&IFF_TUN != 0 {
-				return "tun (TUN virtual L3)"
-			}
-			return "tun/tap"
-		}
-		return "tun/tap"
-	}
-
-	// 2) 驱动名直判
-	switch info.Driver {
-	case "veth":
-		return "veth (virtual ethernet pair)"
-	case "wireguard":
-		return "wireguard (VPN)"
-	case "macvlan":
-		return "macvlan"
-	case "ipvlan":
-		return "ipvlan"
-	case "dummy":
-		return "dummy"
-	case "tun":
-		// 某些内核/发行版 tun/tap 的 driver 都显示为 "tun"
-		return "tun/tap"
-	case "bridge":
-		return "bridge"
-	case "team":
-		return "team"
-	}
-
-	// 3) 名字启发式（备选）
-	if name == "lo" || strings.Contains(info.Flags, "loopback") {
-		return "loopback"
-	}
-	if strings.HasPrefix(name, "br-") || strings.HasPrefix(name, "br") {
-		return "bridge"
-	}
-	if strings.HasPrefix(name, "veth") {
-		return "veth (virtual ethernet pair)"
+func printEnrichedTable(it netinspect.IfInfo) {
+	if it.VLANID != 0 {
+		fmt.Printf("VLAN:       id=%d\n", it.VLANID)
 	}
-	if strings.HasPrefix(name, "gre") || strings.HasPrefix(name, "gretap") {
-		return "gre/gretap"
+	if it.VXLANVNI != 0 {
+		fmt.Printf("VXLAN:      vni=%d remote=%s\n", it.VXLANVNI, dash(it.VXLANRemote))
 	}
-	if strings.HasPrefix(name, "vxlan") {
-		return "vxlan"
+	if it.BondMode != "" {
+		fmt.Printf("Bond:       mode=%s slaves=%s\n", it.BondMode, strings.Join(it.BondSlaves, ","))
 	}
-	if strings.HasPrefix(name, "wg") {
-		return "wireguard"
+	if it.BridgeSTP != "" {
+		fmt.Printf("Bridge:     stp=%s members=%s\n", it.BridgeSTP, strings.Join(it.BridgeMembers, ","))
 	}
-	if strings.HasPrefix(name, "bond") {
-		return "bond"
+	if it.WireGuardPeers != 0 || it.ListenPort != 0 {
+		fmt.Printf("WireGuard:  peers=%d listen-port=%d\n", it.WireGuardPeers, it.ListenPort)
 	}
-	if strings.HasPrefix(name, "team") {
-		return "team"
+	if it.VethPeerIndex != 0 {
+		fmt.Printf("Veth:       peer-ifindex=%d\n", it.VethPeerIndex)
 	}
-	if strings.HasPrefix(name, "macvlan") {
-		return "macvlan"
-	}
-	if strings.HasPrefix(name, "ipvlan") {
-		return "ipvlan"
-	}
-	if strings.HasPrefix(name, "tap") {
-		return "tap"
-	}
-	if strings.HasPrefix(name, "tun") {
-		return "tun"
-	}
-	if strings.HasPrefix(name, "docker") || strings.HasPrefix(name, "cni") {
-		return "bridge (container)"
-	}
-	if strings.HasPrefix(name, "flannel.") {
-		return "vxlan (flannel overlay)"
-	}
-
-	// 4) 物理 vs 虚拟 的兜底
-	if info.IsVirtual {
-		if info.Driver != "" {
-			return "virtual (" + info.Driver + ")"
-		}
-		return "virtual"
-	}
-	if info.Driver != "" {
-		return "physical (" + info.Driver + ")"
-	}
-	return "physical"
-}
-
-func detectDriver(syslink string) string {
-	drv := filepath.Join(syslink, "device", "driver")
-	if target, err := filepath.EvalSymlinks(drv); err == nil && target != "" {
-		// 最后一个目录名就是驱动名
-		return filepath.Base(target)
-	}
-	// 某些虚拟设备没有 device/driver，可尝试 module 名
-	mod := filepath.Join(syslink, "device", "modalias")
-	if b, err := os.ReadFile(mod); err == nil {
-		return strings.TrimSpace(string(b))
-	}
-	return ""
-}
-
-func detectMaster(syslink string) string {
-	m := filepath.Join(syslink, "master")
-	if target, err := filepath.EvalSymlinks(m); err == nil && target != "" {
-		return filepath.Base(target)
-	}
-	return ""
-}
-
-func readFirst(path string) string {
-	b, err := os.ReadFile(path)
-	if err != nil {
-		return ""
-	}
-	return strings.TrimSpace(string(b))
-}
-
-func exists(path string) bool {
-	_, err := os.Stat(path)
-	return err == nil
 }
 
 func dash(s string) string {